@@ -31,9 +31,14 @@ func NewAccount() (*Account, error) {
 	}, nil
 }
 
-func (acc *Account) Sign(tx *Tx) Signature {
-	txHash := tx.Hash()
-	return ed25519.Sign(acc.PrivateKey, txHash[:])
+// Anything which can be signed by signing its hash
+type Signable interface {
+	Hash() SHA256Sum
+}
+
+func (acc *Account) Sign(data Signable) Signature {
+	hash := data.Hash()
+	return ed25519.Sign(acc.PrivateKey, hash[:])
 }
 
 func (acc *Account) Serialize() []byte {
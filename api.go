@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// An HTTP API for external miners and for controlling the miner and the validator votes of a node.
+// Hashes are hex encoded, transactions and blocks are hex encoded in their serialized form.
+//
+//	GET  /blocktemplate[?payTo=ACCOUNT]  Gets a block template, paying the node's mining account by default
+//	POST /submitblock                    Submits a sealed block: {"block": "..."}
+//	GET  /miner                          Gets the status of the miner
+//	POST /miner/start, /miner/stop       Starts or stops the miner
+//	POST /validators/propose             Proposes a validator set change on proof of authority networks:
+//	                                     {"validator": "PUBKEY", "add": true}
+type APIServer struct {
+	node     *Node
+	miner    *Miner
+	addr     string
+	listener net.Listener
+	server   *http.Server
+}
+
+type blockTemplateJSON struct {
+	Height        uint64           `json:"height"`
+	LastBlockHash string           `json:"lastBlockHash"`
+	Timestamp     int64            `json:"timestamp"`
+	Target        string           `json:"target"`
+	Coinbase      string           `json:"coinbase"`
+	Transactions  []templateTxJSON `json:"transactions"`
+}
+
+type templateTxJSON struct {
+	Hash string `json:"hash"`
+	Data string `json:"data"`
+}
+
+type submitBlockJSON struct {
+	Block string `json:"block"`
+}
+
+type minerStatusJSON struct {
+	Running     bool    `json:"running"`
+	BlocksMined uint64  `json:"blocksMined"`
+	Hashrate    float64 `json:"hashrate"`
+}
+
+type proposeValidatorJSON struct {
+	Validator string `json:"validator"`
+	Add       bool   `json:"add"`
+}
+
+type errorJSON struct {
+	Error string `json:"error"`
+}
+
+func NewAPIServer(node *Node, miner *Miner, addr string) *APIServer {
+	api := &APIServer{
+		node:  node,
+		miner: miner,
+		addr:  addr,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blocktemplate", api.handleBlockTemplate)
+	mux.HandleFunc("/submitblock", api.handleSubmitBlock)
+	mux.HandleFunc("/miner", api.handleMinerStatus)
+	mux.HandleFunc("/miner/start", api.handleMinerStart)
+	mux.HandleFunc("/miner/stop", api.handleMinerStop)
+	mux.HandleFunc("/validators/propose", api.handleProposeValidator)
+	api.server = &http.Server{Handler: mux}
+	return api
+}
+
+// Starts serving requests on the address
+func (api *APIServer) Start() error {
+	listener, err := net.Listen("tcp", api.addr)
+	if err != nil {
+		return err
+	}
+	api.listener = listener
+	api.addr = listener.Addr().String()
+	fmt.Printf("API listening on %s\n", api.addr)
+	go api.server.Serve(listener)
+	return nil
+}
+
+func (api *APIServer) Stop() {
+	api.server.Close()
+}
+
+// The address the API is served on. Only known after Start if the port was 0.
+func (api *APIServer) Addr() string {
+	return api.addr
+}
+
+func (api *APIServer) handleBlockTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Use GET"))
+		return
+	}
+	payTo := api.node.bc.miningAccount.Id
+	if raw := r.URL.Query().Get("payTo"); raw != "" {
+		decoded, err := hex.DecodeString(raw)
+		if err != nil || len(decoded) != len(payTo) {
+			writeError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid account '%s'", raw)))
+			return
+		}
+		copy(payTo[:], decoded)
+	}
+
+	template, err := api.node.GetBlockTemplate(payTo)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	response := blockTemplateJSON{
+		Height:        template.Height,
+		LastBlockHash: hex.EncodeToString(template.LastBlockHash[:]),
+		Timestamp:     template.Timestamp,
+		Target:        hex.EncodeToString(template.Target[:]),
+		Coinbase:      hex.EncodeToString(template.Coinbase.Serialize()),
+		Transactions:  make([]templateTxJSON, len(template.Transactions)),
+	}
+	for i, tx := range template.Transactions {
+		txHash := tx.Hash()
+		response.Transactions[i] = templateTxJSON{
+			Hash: hex.EncodeToString(txHash[:]),
+			Data: hex.EncodeToString(tx.Serialize()),
+		}
+	}
+	writeJSON(w, http.StatusOK, &response)
+}
+
+func (api *APIServer) handleSubmitBlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Use POST"))
+		return
+	}
+	var request submitBlockJSON
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	raw, err := hex.DecodeString(request.Block)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var block Block
+	if err := decodePayload(raw, &block); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := api.node.SubmitBlock(&block); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"hash": hex.EncodeToString(block.PoW.Hash[:])})
+}
+
+func (api *APIServer) handleMinerStatus(w http.ResponseWriter, r *http.Request) {
+	status := api.miner.Status()
+	writeJSON(w, http.StatusOK, &minerStatusJSON{
+		Running:     status.Running,
+		BlocksMined: status.BlocksMined,
+		Hashrate:    status.Hashrate,
+	})
+}
+
+func (api *APIServer) handleMinerStart(w http.ResponseWriter, r *http.Request) {
+	api.controlMiner(w, r, api.miner.Start)
+}
+
+func (api *APIServer) handleMinerStop(w http.ResponseWriter, r *http.Request) {
+	api.controlMiner(w, r, api.miner.Stop)
+}
+
+func (api *APIServer) controlMiner(w http.ResponseWriter, r *http.Request, action func() error) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Use POST"))
+		return
+	}
+	if err := action(); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	api.handleMinerStatus(w, r)
+}
+
+func (api *APIServer) handleProposeValidator(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Use POST"))
+		return
+	}
+	var request proposeValidatorJSON
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	validator, err := hex.DecodeString(request.Validator)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := api.node.ProposeValidator(validator, request.Add); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &request)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &errorJSON{Error: err.Error()})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestAPI(t *testing.T) {
+	nodes, _ := createTestNodes(t, 1)
+	node := nodes[0]
+	api := NewAPIServer(node, NewMiner(node, 10), "127.0.0.1:0")
+	if err := api.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer api.Stop()
+	baseURL := "http://" + api.Addr()
+
+	resp, err := http.Get(baseURL + "/blocktemplate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var template blockTemplateJSON
+	err = json.NewDecoder(resp.Body).Decode(&template)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build and seal the block from the template
+	block := NewBlock()
+	coinbase, _ := hex.DecodeString(template.Coinbase)
+	block.AddTransaction(TxDeserialize(coinbase))
+	lastBlockHash, _ := hex.DecodeString(template.LastBlockHash)
+	copy(block.LastBlockHash[:], lastBlockHash)
+	target, _ := hex.DecodeString(template.Target)
+	copy(block.Target[:], target)
+	block.Timestamp = template.Timestamp
+	sealExternally(t, block)
+
+	body, _ := json.Marshal(&submitBlockJSON{Block: hex.EncodeToString(block.Serialize())})
+	resp, err = http.Post(baseURL+"/submitblock", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Submitting the block failed with status %d", resp.StatusCode)
+	}
+	if node.bc.latestBlock != block.PoW.Hash {
+		t.Fatal("Submitted block is not the latest block")
+	}
+
+	// Control the miner
+	for _, action := range []string{"start", "stop"} {
+		resp, err = http.Post(baseURL+"/miner/"+action, "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status minerStatusJSON
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Running != (action == "start") {
+			t.Fatalf("Miner running is %t after %s", status.Running, action)
+		}
+	}
+	resp, err = http.Post(baseURL+"/miner/stop", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected status %d stopping a stopped miner, got %d", http.StatusConflict, resp.StatusCode)
+	}
+}
+
+func TestProposeValidatorAPI(t *testing.T) {
+	chains, accounts, _ := createPoAChains(t, 2, 1)
+	node := NewNode(chains[0], "127.0.0.1:0")
+	api := NewAPIServer(node, NewMiner(node, 10), "127.0.0.1:0")
+	if err := api.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer api.Stop()
+	propose := func(validator []byte) int {
+		body, _ := json.Marshal(&proposeValidatorJSON{Validator: hex.EncodeToString(validator), Add: true})
+		resp, err := http.Post("http://"+api.Addr()+"/validators/propose", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := propose(accounts[1].PublicKey[:5]); status != http.StatusBadRequest {
+		t.Fatalf("Expected status %d proposing a short key, got %d", http.StatusBadRequest, status)
+	}
+	if status := propose(accounts[1].PublicKey); status != http.StatusOK {
+		t.Fatalf("Proposing a validator failed with status %d", status)
+	}
+	block, err := node.MineNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vote := block.Authority.Vote; vote == nil || vote.Account() != accounts[1].Id || !vote.Add {
+		t.Fatal("Validator did not vote for the proposal")
+	}
+}
@@ -2,8 +2,7 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/binary"
+	"context"
 	"encoding/gob"
 	"errors"
 	"fmt"
@@ -14,26 +13,20 @@ type PoW struct {
 	Hash  SHA256Sum
 }
 
-var difficulty SHA256Sum = SHA256Sum{
-	0x00, 0x00, 0b00000100, 0x00, 0x00, 0x00, 0x00, 0x00,
-	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-}
-
 type Block struct {
-	Transactions  []*Tx
-	LastBlockHash SHA256Sum
-	PoW           *PoW
+	BlockHeader
+	Transactions []*Tx
 }
 
 func NewBlock() *Block {
 	return &Block{
-		Transactions: make([]*Tx, 0),
-		PoW: &PoW{
-			Nonce: 0,
-			Hash:  emptyHash,
+		BlockHeader: BlockHeader{
+			PoW: &PoW{
+				Nonce: 0,
+				Hash:  emptyHash,
+			},
 		},
+		Transactions: make([]*Tx, 0),
 	}
 }
 
@@ -63,73 +56,114 @@ func BlockDeserialize(raw []byte) *Block {
 	return &block
 }
 
-// Get the binary representation of the block for hashing purposes
-// Last block hash must be set before.
-func (block *Block) Binary() []byte {
-	if block.LastBlockHash == emptyHash {
-		// Make sure LastBlockHash is set before hashing
-		panic("Tried getting binary of block without last block hash")
-	}
-	var binaryBlock []byte
-	for _, tx := range block.Transactions {
-		binaryBlock = append(binaryBlock, tx.Binary()...)
-	}
-	binaryBlock = append(binaryBlock, block.LastBlockHash[:]...)
-	return binaryBlock
-}
-
-func (block *Block) Mine() {
+// Commits the header to the transactions and seals it using the consensus engine of the chain.
+// If the nonce space is exhausted, the extra nonce of the mining reward transaction is rolled,
+// which changes the Merkle root without touching the other transactions.
+// Sealing stops with the error of ctx if it is cancelled.
+func (bc *Blockchain) SealBlock(ctx context.Context, block *Block) error {
 	fmt.Println("Mining block...")
 
-	binaryBlock := block.Binary()
-
-	block.PoW.Nonce = 0
-	nonceRaw := make([]byte, 8)
-
 	for {
-		binary.LittleEndian.PutUint64(nonceRaw, block.PoW.Nonce)
-		sum := sha256.Sum256(append(binaryBlock, nonceRaw...))
-		if bytes.Compare(difficulty[:], sum[:]) > 0 {
-			// Valid Nonce
-			block.PoW.Hash = sum
+		block.MerkleRoot = block.CalcMerkleRoot()
+		err := bc.params.Engine.Seal(ctx, bc, &block.BlockHeader)
+		if err == nil {
 			break
-		} else {
-			// Invalid Nonce
-			block.PoW.Nonce += 1
 		}
+		if err != ErrNonceSpaceExhausted || len(block.Transactions) == 0 || block.Transactions[0].Coinbase == nil {
+			return err
+		}
+		block.Transactions[0].Coinbase.ExtraNonce++
+		fmt.Printf("Nonce space exhausted, rolling the extra nonce to %d\n", block.Transactions[0].Coinbase.ExtraNonce)
 	}
 	fmt.Println("Success!")
 	block.Print()
+	return nil
 }
 
-// Verifies the PoW aswell as all transactions
+// Verifies the seal aswell as all transactions.
+// The transactions are checked against the current UTxO set, so the block has to extend the latest block.
 func (bc *Blockchain) VerifyBlock(block *Block) error {
-	// Verify the PoW
-	nonceRaw := make([]byte, 8)
-	binary.LittleEndian.PutUint64(nonceRaw, block.PoW.Nonce)
-	blockHash := sha256.Sum256(append(block.Binary(), nonceRaw...))
-	if bytes.Compare(difficulty[:], blockHash[:]) <= 0 {
-		// Invalid PoW
-		return errors.New(fmt.Sprintf("Block invalid! The PoW is not valid."))
-	}
-
-	// Verify all transactions
-	for txIdx, tx := range block.Transactions {
-		if txIdx == 0 {
-			// Mining reward transaction. This may mint new coins.
-			if len(tx.Outputs) != 1 {
-				return errors.New(fmt.Sprintf("Block invalid! Mining reward transaction has wrong number of outputs."))
-			}
-			if tx.Outputs[0].Value != miningReward {
-				return errors.New(fmt.Sprintf("Block invalid! Mining reward transaction outputs invalid reward size."))
-			}
-		} else {
-			if err := bc.VerifyTransaction(tx); err != nil {
-				return err
-			}
-		}
+	if err := bc.verifyBlockStructure(block); err != nil {
+		return err
+	}
+	return bc.verifyBlockTransactions(block)
+}
+
+// Verifies everything about a block which doesn't depend on the UTxO set
+func (bc *Blockchain) verifyBlockStructure(block *Block) error {
+	// Verify the seal
+	if err := bc.params.Engine.VerifySeal(bc, &block.BlockHeader); err != nil {
+		return err
+	}
+	if err := bc.verifyHeaderContext(&block.BlockHeader); err != nil {
+		return err
+	}
+
+	if len(block.Transactions) > bc.params.MaxBlockTransactions {
+		return errors.New(fmt.Sprintf("Block invalid! %d transactions exceed the limit of %d.", len(block.Transactions), bc.params.MaxBlockTransactions))
 	}
+	if size := len(block.Serialize()); size > bc.params.MaxBlockSize {
+		return errors.New(fmt.Sprintf("Block invalid! Size of %d bytes exceeds the limit of %d.", size, bc.params.MaxBlockSize))
+	}
+
+	// Verify the header commits to the transactions
+	if block.MerkleRoot != block.CalcMerkleRoot() {
+		return errors.New(fmt.Sprintf("Block invalid! Transactions do not match the Merkle root."))
+	}
+
+	if len(block.Transactions) == 0 {
+		return errors.New(fmt.Sprintf("Block invalid! Mining reward transaction is missing."))
+	}
+	// Mining reward transaction. This may mint new coins.
+	rewardTx := block.Transactions[0]
+	height, err := bc.childHeight(block.LastBlockHash)
+	if err != nil {
+		return err
+	}
+	if rewardTx.Coinbase == nil || rewardTx.Coinbase.Height != height {
+		return errors.New(fmt.Sprintf("Block invalid! Mining reward transaction does not commit to the block height %d.", height))
+	}
+	if len(rewardTx.Coinbase.Tag) > maxCoinbaseTag {
+		return errors.New(fmt.Sprintf("Block invalid! Mining reward transaction tag is longer than %d bytes.", maxCoinbaseTag))
+	}
+	if len(rewardTx.Inputs) != 0 {
+		return errors.New(fmt.Sprintf("Block invalid! Mining reward transaction has inputs."))
+	}
+	if len(rewardTx.Outputs) == 0 {
+		return errors.New(fmt.Sprintf("Block invalid! Mining reward transaction has no outputs."))
+	}
+	return nil
+}
 
+// Verifies all transactions except the mining reward against the UTxO set.
+// An output may only be spent once, even by different transactions of the block.
+// The mining reward may claim at most the block reward for its height plus the fees of all other transactions.
+func (bc *Blockchain) verifyBlockTransactions(block *Block) error {
+	height, err := bc.childHeight(block.LastBlockHash)
+	if err != nil {
+		return err
+	}
+	spent := make(map[TxOPath]bool)
+	var fees uint64
+	for _, tx := range block.Transactions[1:] {
+		fee, err := bc.verifyTransaction(tx, spent, height)
+		if err != nil {
+			return err
+		}
+		fees += fee
+	}
+	available := bc.params.BlockReward(height) + fees
+	// The reward may be split between several outputs, e.g. to pay the workers of a mining pool
+	var claimed uint64
+	for _, out := range block.Transactions[0].Outputs {
+		if claimed+out.Value < claimed {
+			return errors.New("Block invalid! Mining reward transaction value overflows.")
+		}
+		claimed += out.Value
+	}
+	if claimed > available {
+		return errors.New(fmt.Sprintf("Block invalid! Mining reward transaction claims %d, but only %d are available.", claimed, available))
+	}
 	return nil
 }
 
@@ -141,6 +175,7 @@ func (block *Block) Print() {
 		tx.Print("\t\t")
 	}
 	fmt.Println("\tProof of Work:")
+	fmt.Printf("\t\tTarget: %x\n", block.Target)
 	fmt.Printf("\t\tNonce: %d\n", block.PoW.Nonce)
 	fmt.Printf("\t\tPoW hash: %x\n", block.PoW.Hash)
 }
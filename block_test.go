@@ -40,13 +40,15 @@ func createBlock() *Block {
 
 func TestSerialization(t *testing.T) {
 	org_block := &Block{
+		BlockHeader: BlockHeader{
+			PoW: &PoW{
+				Nonce: 123,
+				Hash:  sha256.Sum256([]byte("Something")),
+			},
+		},
 		Transactions: []*Tx{
 			createTx(),
 		},
-		PoW: &PoW{
-			Nonce: 123,
-			Hash:  sha256.Sum256([]byte("Something")),
-		},
 	}
 	ser := org_block.Serialize()
 	des_block := BlockDeserialize(ser)
@@ -56,3 +58,42 @@ func TestSerialization(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestCoinbaseCommitsToHeight(t *testing.T) {
+	chains, _ := createTestChains(t, 2)
+	a, b := chains[0], chains[1]
+
+	// The same miner gets the same reward in every block, but the hashes differ
+	hashes := make(map[SHA256Sum]bool)
+	for i := 0; i < 3; i++ {
+		block, err := a.MineNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[block.Transactions[0].Hash()] = true
+	}
+	if len(hashes) != 3 {
+		t.Fatal("Mining reward transactions share a hash")
+	}
+
+	block, err := b.MineNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RewindTo(1); err != nil {
+		t.Fatal(err)
+	}
+	block.Transactions[0].Coinbase.Height = 3
+	sealBlock(t, b, block)
+	if err := b.VerifyBlock(block); err == nil {
+		t.Fatal("Accepted mining reward transaction committing to the wrong height")
+	}
+
+	block.Transactions[0].Coinbase.Height = 2
+	block.Transactions[0].Coinbase.Tag = []byte("miner")
+	block.AddTransaction(NewCoinbaseTx(2, AccountId(emptyHash), 0))
+	sealBlock(t, b, block)
+	if err := b.VerifyBlock(block); err == nil {
+		t.Fatal("Accepted a second mining reward transaction")
+	}
+}
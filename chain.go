@@ -1,35 +1,51 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
 type SHA256Sum [sha256.Size]byte
 
-type Mempool struct {
-	pool []*Tx
-}
-
 type Blockchain struct {
 	db            *bolt.DB
+	params        *ChainParams
 	mempool       *Mempool
+	orphans       *OrphanPool
 	latestBlock   SHA256Sum
+	latestHeight  uint64 // The genesis block has height 0
+	latestHeader  SHA256Sum
 	miningAccount *Account
+	// Validator set changes the mining account votes for on proof of authority networks.
+	// A node seals blocks without holding its chain lock, so the proposals have their own.
+	proposals   map[AccountId]*ValidatorVote
+	proposalsMu sync.Mutex
+	// Hashes of the proof of work the chain is sealing
+	hashMeter hashMeter
 }
 
 const (
 	chainBucketName    string = "chain"
+	headersBucketName  string = "headers"
+	indexBucketName    string = "index"
+	undoBucketName     string = "undo"
 	utxoBucketName     string = "utxo"
 	keystoreBucketName string = "keystore"
 	miscBucketName     string = "misc"
 	latestBlockKey     string = "latestBlock"
-	miningReward       uint64 = 100
+	latestHeaderKey    string = "latestHeader"
 )
 
+// The clock used for block timestamps. Replaced in tests.
+var now = time.Now
+
 // An unset, all zero hash used for comparisons
 var emptyHash SHA256Sum
 
@@ -60,8 +76,32 @@ func recreateBucket(db *bolt.DB, bucketName string) error {
 	return err
 }
 
-// Creates a new blockchain object by
-func NewBlockchain(dbFile string, miningAcc *Account) (*Blockchain, error) {
+// Gets a database bucket of the network the chain belongs to
+func (bc *Blockchain) bucket(t *bolt.Tx, name string) *bolt.Bucket {
+	return t.Bucket([]byte(bc.params.bucketName(name)))
+}
+
+// Creates a new blockchain object for a network by opening the database file.
+// If the chain is empty, it is initialized with the genesis block of the network.
+func NewBlockchain(dbFile string, miningAcc *Account, params *ChainParams) (*Blockchain, error) {
+	bc, err := OpenBlockchain(dbFile, miningAcc, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if bc.IsEmpty() {
+		if err := bc.Initialize(); err != nil {
+			panic(err)
+		}
+	}
+
+	return bc, nil
+}
+
+// Opens a blockchain without creating a genesis block if the chain is empty.
+// Used by nodes which download the chain from a peer.
+// Fails if the database contains a chain with another genesis block.
+func OpenBlockchain(dbFile string, miningAcc *Account, params *ChainParams) (*Blockchain, error) {
 	db, err := bolt.Open(dbFile, 0666, nil)
 	if err != nil {
 		return nil, err
@@ -69,9 +109,10 @@ func NewBlockchain(dbFile string, miningAcc *Account) (*Blockchain, error) {
 
 	// Default is an empty chain
 	latestBlock := nullHash
+	latestHeader := nullHash
 
 	db.View(func(t *bolt.Tx) error {
-		miscBucket := t.Bucket([]byte(miscBucketName))
+		miscBucket := t.Bucket([]byte(params.bucketName(miscBucketName)))
 		if miscBucket == nil {
 			return nil
 		}
@@ -79,47 +120,94 @@ func NewBlockchain(dbFile string, miningAcc *Account) (*Blockchain, error) {
 		if res != nil {
 			copy(latestBlock[:], res[0:sha256.Size])
 		}
+		res = miscBucket.Get([]byte(latestHeaderKey))
+		if res != nil {
+			copy(latestHeader[:], res[0:sha256.Size])
+		}
 		return nil
 	})
 
 	bc := Blockchain{
 		db:            db,
+		params:        params,
 		mempool:       NewMempool(),
+		orphans:       NewOrphanPool(maxOrphans, maxOrphanBytes, orphanExpiry),
 		latestBlock:   latestBlock,
+		latestHeader:  latestHeader,
 		miningAccount: miningAcc,
+		proposals:     make(map[AccountId]*ValidatorVote),
 	}
 
-	if bc.IsEmpty() {
-		if err := bc.Initialize(); err != nil {
-			panic(err)
+	// Make sure all buckets exist, so blocks can be added
+	if err := bc.createBuckets(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if !bc.IsEmpty() {
+		if _, err := bc.GetIndex(params.GenesisHash); err != nil {
+			db.Close()
+			return nil, errors.New(fmt.Sprintf("Database does not contain the %s genesis block '%x'", params.Name, params.GenesisHash))
+		}
+		tipIndex, err := bc.GetIndex(bc.latestBlock)
+		if err != nil {
+			db.Close()
+			return nil, err
 		}
+		bc.latestHeight = tipIndex.Height
 	}
 
 	return &bc, nil
 }
 
+// Creates all database buckets which don't exist yet
+func (bc *Blockchain) createBuckets() error {
+	return bc.db.Update(func(t *bolt.Tx) error {
+		for _, bucketName := range []string{chainBucketName, headersBucketName, indexBucketName, undoBucketName, utxoBucketName, keystoreBucketName, miscBucketName} {
+			if _, err := t.CreateBucketIfNotExists([]byte(bc.params.bucketName(bucketName))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // Creates a blank blockchain, overwriting any existing chain.
-// Creates and mines the genesis block.
+// Adds the genesis block of the network.
 func (bc *Blockchain) Initialize() error {
 	// (Re)create all database buckets
-	if err := recreateBucket(bc.db, chainBucketName); err != nil {
+	if err := recreateBucket(bc.db, bc.params.bucketName(chainBucketName)); err != nil {
 		return err
 	}
-	if err := recreateBucket(bc.db, utxoBucketName); err != nil {
+	if err := recreateBucket(bc.db, bc.params.bucketName(headersBucketName)); err != nil {
 		return err
 	}
-	if err := recreateBucket(bc.db, keystoreBucketName); err != nil {
+	if err := recreateBucket(bc.db, bc.params.bucketName(indexBucketName)); err != nil {
 		return err
 	}
-	if err := recreateBucket(bc.db, miscBucketName); err != nil {
+	if err := recreateBucket(bc.db, bc.params.bucketName(undoBucketName)); err != nil {
+		return err
+	}
+	if err := recreateBucket(bc.db, bc.params.bucketName(utxoBucketName)); err != nil {
+		return err
+	}
+	if err := recreateBucket(bc.db, bc.params.bucketName(keystoreBucketName)); err != nil {
+		return err
+	}
+	if err := recreateBucket(bc.db, bc.params.bucketName(miscBucketName)); err != nil {
 		return err
 	}
 
+	bc.latestBlock = nullHash
+	bc.latestHeader = nullHash
+	bc.latestHeight = 0
 	bc.GenerateUTxO()
 
 	fmt.Println("GENESIS")
-	// Mine genesis block
-	if _, err := bc.MineNext(); err != nil {
+	genesis := bc.params.GenesisBlock()
+	if err := bc.params.Engine.VerifySeal(bc, &genesis.BlockHeader); err != nil {
+		return err
+	}
+	if err := bc.AddBlock(genesis); err != nil {
 		return err
 	}
 
@@ -128,39 +216,23 @@ func (bc *Blockchain) Initialize() error {
 	return nil
 }
 
-func NewMempool() *Mempool {
-	return &Mempool{
-		pool: make([]*Tx, 0, 10),
-	}
-}
-
-func (mp *Mempool) Push(tx *Tx) {
-	mp.pool = append(mp.pool, tx)
-}
-
-func (mp *Mempool) Pop() (*Tx, error) {
-	if len(mp.pool) == 0 {
-		return nil, errors.New("Mempool empty")
+// Creates a transaction for `value` coins paying `fee` to the miner and pushes it into the mempool.
+// Outputs already spent by transactions in the mempool and immature mining rewards are not used.
+func (bc *Blockchain) Send(from *Account, to AccountId, value uint64, fee uint64) (*Tx, error) {
+	fmt.Printf("'%x' is sending %d to '%x' with a fee of %d\n", from.Id, value, to, fee)
+	pending := bc.mempool.SpentOutputs()
+	utxos := &UTxOs{}
+	for _, utxo := range *bc.GetUTxOsForUser(from.Id) {
+		if !pending[utxo.Path] && utxo.Mature(bc.latestHeight+1, bc.params.CoinbaseMaturity) {
+			*utxos = append(*utxos, utxo)
+		}
 	}
-	tx := mp.pool[0]
-	mp.pool = mp.pool[1:]
-	return tx, nil
-}
-
-func (mp *Mempool) Count() int {
-	return len(mp.pool)
-}
-
-// Creates a transaction for `value` coins and pushes it into the mempool
-func (bc *Blockchain) Send(from *Account, to AccountId, value uint64) error {
-	fmt.Printf("'%x' is sending %d to '%x'\n", from.Id, value, to)
-	utxos := bc.GetUTxOsForUser(from.Id)
-	sufficientFunds := utxos.Balance() >= value
+	sufficientFunds := utxos.Balance() >= value+fee
 	if sufficientFunds {
 		var currValue uint64
 		inputs := make([]TxI, 0)
 		for _, utxo := range *utxos {
-			if currValue >= value {
+			if currValue >= value+fee {
 				break
 			} else {
 				inputs = append(inputs, TxI{
@@ -176,7 +248,7 @@ func (bc *Blockchain) Send(from *Account, to AccountId, value uint64) error {
 			To:    to,
 		}
 
-		change := currValue - value
+		change := currValue - value - fee
 		changeOutput := TxO{
 			Value: change,
 			To:    from.Id,
@@ -191,77 +263,230 @@ func (bc *Blockchain) Send(from *Account, to AccountId, value uint64) error {
 		)
 		sig := from.Sign(tx)
 		tx.Signatures[from.Id] = sig
-		bc.mempool.Push(tx)
-		return nil
+		tx.Keys = map[AccountId]ed25519.PublicKey{from.Id: from.PublicKey}
+		if err := bc.mempool.Push(tx); err != nil {
+			return nil, err
+		}
+		return tx, nil
 	} else {
-		return errors.New(fmt.Sprintf("'%x' has insufficient funds to send %d coins", from.Id, value))
+		return nil, errors.New(fmt.Sprintf("'%x' has insufficient funds to send %d coins with a fee of %d", from.Id, value, fee))
 	}
 }
 
-// Appends a block to the blockchain
-// Fails if the blocks LastBlockHash doesn't match the latest block
-// or if the block has not been mined yet
+// Stores a block and switches the main chain to the chain with the most cumulative work.
+// Blocks on side branches are kept, so they can become part of the main chain later.
+// The transactions of a block are verified against the UTxO set when it is connected to the main chain.
+// Fails if the parent block is unknown or invalid, if the block has not been mined yet
+// or if its transactions are invalid.
 func (bc *Blockchain) AddBlock(block *Block) error {
-	if block.LastBlockHash != bc.latestBlock {
-		return errors.New("Block is not a valid extension of the chain")
-	}
 	if block.PoW.Hash == emptyHash {
 		return errors.New("Block is not mined yet")
 	}
+	if block.LastBlockHash != nullHash && !bc.HasBlock(block.LastBlockHash) {
+		return errors.New("Block is not a valid extension of the chain")
+	}
+	var entry *BlockIndex
 	err := bc.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(chainBucketName))
-		bucket.Put(block.PoW.Hash[:], block.Serialize())
-		return nil
+		var err error
+		if entry, err = bc.indexHeader(tx, &block.BlockHeader); err != nil {
+			return err
+		}
+		bucket := bc.bucket(tx, chainBucketName)
+		return bucket.Put(block.PoW.Hash[:], block.Serialize())
 	})
-	if err := bc.SetLatestBlock(block.PoW.Hash); err != nil {
+	if err != nil {
+		return err
+	}
+
+	// Descendants of invalid blocks are indexed as invalid, so the failing reorganization isn't tried again
+	if entry.Invalid {
+		return errors.New(fmt.Sprintf("Block '%x' is invalid or extends an invalid block", block.PoW.Hash))
+	}
+
+	if !bc.IsEmpty() {
+		tipIndex, err := bc.GetIndex(bc.latestBlock)
+		if err != nil {
+			return err
+		}
+		if entry.ChainWork.Cmp(tipIndex.ChainWork) <= 0 {
+			// Not (yet) the chain with the most work
+			return nil
+		}
+	}
+	return bc.reorganize(block.PoW.Hash)
+}
+
+// Makes the chain ending in newTip the main chain.
+// Blocks of the old main chain after the fork point are disconnected,
+// then the blocks of the new chain are connected in order.
+func (bc *Blockchain) reorganize(newTip SHA256Sum) error {
+	disconnect, connect, err := bc.forkPaths(bc.latestBlock, newTip)
+	if err != nil {
 		return err
 	}
 
+	if len(disconnect) > 0 {
+		fmt.Printf("Reorganizing chain: disconnecting %d and connecting %d blocks\n", len(disconnect), len(connect))
+	}
+	disconnected := make([]*Block, 0, len(disconnect))
+	for range disconnect {
+		block, err := bc.DisconnectBlock()
+		if err != nil {
+			return err
+		}
+		disconnected = append(disconnected, block)
+	}
+
+	connected := make([]*Block, 0, len(connect))
+	for _, hash := range connect {
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+		// The UTxO set is at the state of the parent now, so the transactions can be verified
+		if verifyErr := bc.verifyBlockTransactions(block); verifyErr != nil {
+			fmt.Printf("Block '%x' is invalid: %s\n", hash, verifyErr)
+			// Switch back to the old chain
+			for range connected {
+				if _, err := bc.DisconnectBlock(); err != nil {
+					return err
+				}
+			}
+			for i := len(disconnected) - 1; i >= 0; i-- {
+				if err := bc.connectBlock(disconnected[i]); err != nil {
+					return err
+				}
+			}
+			bc.readmitTransactions(connected)
+			// The block and its descendants, including the new tip, can't become part of the main chain
+			if err := bc.markInvalid(hash); err != nil {
+				return err
+			}
+			return verifyErr
+		}
+		if err := bc.connectBlock(block); err != nil {
+			return err
+		}
+		connected = append(connected, block)
+	}
+
+	// Transactions of the old chain which are not part of the new chain can be mined again
+	bc.readmitTransactions(disconnected)
+	return nil
+}
+
+// Makes a block the new tip and applies it to the UTxO set.
+// The block has to extend the current tip.
+func (bc *Blockchain) connectBlock(block *Block) error {
+	if err := bc.setTip(block.PoW.Hash); err != nil {
+		return err
+	}
 	bc.UpdateUTxOSet(block)
+	bc.mempool.RemoveBlockTransactions(block)
+	return nil
+}
 
-	return err
+// Pushes the transactions of disconnected blocks back into the mempool, if they are still valid
+func (bc *Blockchain) readmitTransactions(blocks []*Block) {
+	spent := bc.mempool.SpentOutputs()
+	for _, block := range blocks {
+		// The mining reward is only valid in its own block
+		for _, tx := range block.Transactions[1:] {
+			if bc.mempool.Find(tx.Hash()) != nil {
+				continue
+			}
+			if _, err := bc.verifyTransaction(tx, spent, bc.latestHeight+1); err != nil {
+				continue
+			}
+			bc.mempool.Push(tx)
+		}
+	}
+}
+
+// Sets the latest block of the main chain and its height
+func (bc *Blockchain) setTip(tip SHA256Sum) error {
+	entry, err := bc.GetIndex(tip)
+	if err != nil {
+		return err
+	}
+	if err := bc.SetLatestBlock(tip); err != nil {
+		return err
+	}
+	bc.latestHeight = entry.Height
+	return nil
 }
 
+// Mines a block on top of the latest block and adds it to the chain
 func (bc *Blockchain) MineNext() (*Block, error) {
+	return bc.MineNextContext(context.Background())
+}
+
+// Mines a block like MineNext. Mining stops with the error of ctx if it is cancelled.
+func (bc *Blockchain) MineNextContext(ctx context.Context) (*Block, error) {
+	block, err := bc.prepareBlock(map[AccountId]uint64{bc.miningAccount.Id: 1})
+	if err != nil {
+		return nil, err
+	}
+	if err := bc.SealBlock(ctx, block); err != nil {
+		return nil, err
+	}
+	if err := bc.AddBlock(block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// Creates an unsealed block on top of the latest block from the best paying transactions of the mempool,
+// splitting the mining reward between the accounts of `payTo` in proportion to their shares.
+// The transactions stay in the mempool until the block is connected.
+func (bc *Blockchain) prepareBlock(payTo map[AccountId]uint64) (*Block, error) {
+	var shares uint64
+	for _, count := range payTo {
+		shares += count
+	}
+	if shares == 0 {
+		return nil, errors.New("No account to pay the mining reward to")
+	}
 	block := NewBlock()
+	height, err := bc.childHeight(bc.latestBlock)
+	if err != nil {
+		return nil, err
+	}
 
-	// Add mining reward transaction
-	// The mining reward transaction is always the first transaction in a block
-	miningRewardTx := NewTx(
-		[]TxI{},
-		[]TxO{
-			{
-				To:    bc.miningAccount.Id,
-				Value: miningReward,
-			},
-		},
-		map[AccountId]Signature{},
-	)
-	block.AddTransaction(miningRewardTx)
-
-	// TODO: Later the decision which transactions to mine should be made based on fees
-	for bc.mempool.Count() > 0 {
-		tx, err := bc.mempool.Pop()
+	block.LastBlockHash = bc.latestBlock
+	block.Timestamp = now().Unix()
+	if !bc.IsEmpty() {
+		// Blocks mined within the same second still need increasing timestamps
+		medianTimePast, err := bc.MedianTimePast(bc.latestBlock)
 		if err != nil {
 			return nil, err
 		}
-		if err := bc.VerifyTransaction(tx); err != nil {
-			return nil, err
+		if block.Timestamp <= medianTimePast {
+			block.Timestamp = medianTimePast + 1
 		}
-		block.AddTransaction(tx)
 	}
+	target, err := bc.NextTarget(block.LastBlockHash)
+	if err != nil {
+		return nil, err
+	}
+	block.Target = target
 
-	block.LastBlockHash = bc.latestBlock
-	block.Mine()
-
-	bc.AddBlock(block)
+	txs, fees := bc.selectTransactions(height, coinbaseBlockSize(height, len(payTo)))
+	// Add mining reward transaction
+	// The mining reward transaction is always the first transaction in a block
+	coinbase := NewCoinbaseTx(height, AccountId{}, 0)
+	coinbase.Outputs = splitReward(bc.params.BlockReward(height)+fees, payTo)
+	block.AddTransaction(coinbase)
+	for _, tx := range txs {
+		block.AddTransaction(tx)
+	}
 	return block, nil
 }
 
 func (bc *Blockchain) GetBlock(powHash SHA256Sum) (*Block, error) {
 	var block *Block
 	err := bc.db.View(func(t *bolt.Tx) error {
-		bucket := t.Bucket([]byte(chainBucketName))
+		bucket := bc.bucket(t, chainBucketName)
 		raw := bucket.Get(powHash[:])
 		if raw == nil {
 			return errors.New("Block '" + fmt.Sprintf("%x", powHash) + "' not found!")
@@ -274,7 +499,7 @@ func (bc *Blockchain) GetBlock(powHash SHA256Sum) (*Block, error) {
 
 func (bc *Blockchain) SetLatestBlock(lb SHA256Sum) error {
 	err := bc.db.Update(func(t *bolt.Tx) error {
-		miscBucket := t.Bucket([]byte(miscBucketName))
+		miscBucket := bc.bucket(t, miscBucketName)
 		if miscBucket == nil {
 			return errors.New("Unable to set latest block! Misc bucket not found.")
 		}
@@ -288,6 +513,22 @@ func (bc *Blockchain) SetLatestBlock(lb SHA256Sum) error {
 	return nil
 }
 
+// Returns the hashes of all blocks in the chain, starting with the genesis block
+func (bc *Blockchain) MainChain() []SHA256Sum {
+	return bc.chainFrom(bc.latestBlock)
+}
+
+// Height of the latest block. Only meaningful if the chain is not empty.
+func (bc *Blockchain) Height() uint64 {
+	return bc.latestHeight
+}
+
+// Checks whether a block is stored in the chain bucket
+func (bc *Blockchain) HasBlock(powHash SHA256Sum) bool {
+	_, err := bc.GetBlock(powHash)
+	return err == nil
+}
+
 func (bc *Blockchain) IsEmpty() bool {
 	return bc.latestBlock == nullHash
 }
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Creates regtest chains, see createTestChainsWithParams
+func createTestChains(t *testing.T, count int) ([]*Blockchain, []*Account) {
+	params := RegtestParams
+	return createTestChainsWithParams(t, count, &params)
+}
+
+// Creates a chain with the genesis block and a block paying the first miner and copies its database
+// into a file per chain, so all chains start out with the same blocks and the first miner has coins to spend.
+// Every chain has its own miner. The chains share the parameters.
+func createTestChainsWithParams(t *testing.T, count int, params *ChainParams) ([]*Blockchain, []*Account) {
+	dir := t.TempDir()
+	templateFile := filepath.Join(dir, "template.db")
+	miners := make([]*Account, count)
+	for i := range miners {
+		miners[i], _ = NewAccount()
+	}
+	bc, err := NewBlockchain(templateFile, miners[0], params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.MineNext(); err != nil {
+		t.Fatal(err)
+	}
+	bc.Close()
+	template, err := os.ReadFile(templateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chains := make([]*Blockchain, count)
+	for i := range chains {
+		dbFile := filepath.Join(dir, "chain"+string(rune('a'+i))+".db")
+		if err := os.WriteFile(dbFile, template, 0666); err != nil {
+			t.Fatal(err)
+		}
+		if chains[i], err = NewBlockchain(dbFile, miners[i], params); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, bc := range chains {
+			bc.Close()
+		}
+	})
+	return chains, miners
+}
+
+func TestReorganization(t *testing.T) {
+	chains, miners := createTestChains(t, 2)
+	a, b := chains[0], chains[1]
+
+	sideBlock, err := a.MineNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	competing := make([]*Block, 2)
+	for i := range competing {
+		if competing[i], err = b.MineNext(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Equal work doesn't replace the current chain
+	if err := a.AddBlock(competing[0]); err != nil {
+		t.Fatal(err)
+	}
+	if a.latestBlock != sideBlock.PoW.Hash {
+		t.Fatal("Switched to a chain without more work")
+	}
+
+	if err := a.AddBlock(competing[1]); err != nil {
+		t.Fatal(err)
+	}
+	if a.latestBlock != competing[1].PoW.Hash || a.Height() != 3 {
+		t.Fatal("Did not switch to the chain with the most work")
+	}
+	if !a.HasBlock(sideBlock.PoW.Hash) {
+		t.Fatal("Side branch was not kept")
+	}
+	// Only the genesis reward remains for the miner of the side branch
+	if balance := a.GetUTxOsForUser(miners[0].Id).Balance(); balance != a.params.InitialReward {
+		t.Fatalf("Expected balance %d after reorg, got %d", a.params.InitialReward, balance)
+	}
+	if balance := a.GetUTxOsForUser(miners[1].Id).Balance(); balance != 2*a.params.InitialReward {
+		t.Fatalf("Expected balance %d after reorg, got %d", 2*a.params.InitialReward, balance)
+	}
+}
+
+func TestRewind(t *testing.T) {
+	chains, miners := createTestChains(t, 1)
+	bc, miner := chains[0], miners[0]
+	receiver, _ := NewAccount()
+
+	balances := func() [2]uint64 {
+		return [2]uint64{
+			bc.GetUTxOsForUser(miner.Id).Balance(),
+			bc.GetUTxOsForUser(receiver.Id).Balance(),
+		}
+	}
+	history := [][2]uint64{balances()}
+	for i := 0; i < 3; i++ {
+		if _, err := bc.Send(miner, receiver.Id, 30, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bc.MineNext(); err != nil {
+			t.Fatal(err)
+		}
+		history = append(history, balances())
+	}
+
+	// Regenerating from scratch has to produce the same set
+	bc.GenerateUTxO()
+	if balances() != history[3] {
+		t.Fatalf("Regenerated balances %v don't match %v", balances(), history[3])
+	}
+
+	// The history starts after the block funding the miner
+	for i := 2; i >= 0; i-- {
+		height := uint64(i + 1)
+		if err := bc.RewindTo(height); err != nil {
+			t.Fatal(err)
+		}
+		if bc.Height() != height {
+			t.Fatalf("Expected height %d, got %d", height, bc.Height())
+		}
+		if balances() != history[i] {
+			t.Fatalf("Balances %v at height %d don't match %v", balances(), height, history[i])
+		}
+	}
+
+	if err := bc.RewindTo(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.DisconnectBlock(); err == nil {
+		t.Fatal("Disconnected the genesis block")
+	}
+}
+
+// Seals a block modified by a test using the consensus engine of a chain
+func sealBlock(t *testing.T, bc *Blockchain, block *Block) {
+	if err := bc.SealBlock(context.Background(), block); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Creates a signed transaction which sends an output to another account, except for the fee
+func spendOutput(from *Account, utxo *UTxO, to AccountId, fee uint64) *Tx {
+	tx := NewTx(
+		[]TxI{{From: from.Id, Output: &utxo.Path}},
+		[]TxO{{Value: utxo.Value - fee, To: to}},
+		make(map[AccountId]Signature),
+	)
+	tx.Signatures[from.Id] = from.Sign(tx)
+	tx.Keys = map[AccountId]ed25519.PublicKey{from.Id: from.PublicKey}
+	return tx
+}
+
+func TestDoubleSpends(t *testing.T) {
+	chains, miners := createTestChains(t, 2)
+	a, b := chains[0], chains[1]
+	alice, _ := NewAccount()
+	bob, _ := NewAccount()
+
+	reward := (*a.GetUTxOsForUser(miners[0].Id))[0]
+	toAlice := spendOutput(miners[0], reward, alice.Id, 0)
+	toBob := spendOutput(miners[0], reward, bob.Id, 0)
+
+	// Only the first of two conflicting transactions is mined
+	a.mempool.Push(toAlice)
+	a.mempool.Push(toBob)
+	block, err := a.MineNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Transactions) != 2 || block.Transactions[1].Hash() != toAlice.Hash() {
+		t.Fatal("Conflicting transaction was mined")
+	}
+
+	// Spending an output which is spent in the chain
+	var doubleSpend *DoubleSpendError
+	if err := a.VerifyTransaction(toBob); !errors.As(err, &doubleSpend) {
+		t.Fatalf("Expected double spend error, got %v", err)
+	}
+	if doubleSpend.Path != reward.Path {
+		t.Fatal("Double spend error reports the wrong output")
+	}
+
+	// Spending an output twice within a block
+	block.AddTransaction(toBob)
+	sealBlock(t, b, block)
+	if err := b.VerifyBlock(block); !errors.As(err, &doubleSpend) {
+		t.Fatalf("Expected double spend error, got %v", err)
+	}
+	if _, err := b.ProcessBlock(block); !errors.As(err, &doubleSpend) {
+		t.Fatalf("Expected double spend error, got %v", err)
+	}
+	if b.Height() != 1 || b.GetUTxOsForUser(miners[0].Id).Balance() != b.params.InitialReward {
+		t.Fatal("Block with a double spend was connected")
+	}
+	if entry, err := b.GetIndex(block.PoW.Hash); err != nil || !entry.Invalid {
+		t.Fatal("Block with a double spend was not marked invalid")
+	}
+}
+
+func TestInvalidDescendants(t *testing.T) {
+	chains, miners := createTestChains(t, 2)
+	a, b := chains[0], chains[1]
+	alice, _ := NewAccount()
+	reward := (*a.GetUTxOsForUser(miners[0].Id))[0]
+	a.mempool.Push(spendOutput(miners[0], reward, alice.Id, 0))
+	valid, err := a.MineNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := a.MineNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy of the valid block spending the reward twice, and a child of it
+	invalid := *valid
+	invalid.PoW = &PoW{}
+	invalid.Transactions = append(append([]*Tx{}, valid.Transactions...), spendOutput(miners[0], reward, alice.Id, 1))
+	sealBlock(t, b, &invalid)
+	invalidChild := *child
+	invalidChild.PoW = &PoW{}
+	invalidChild.LastBlockHash = invalid.PoW.Hash
+	sealBlock(t, b, &invalidChild)
+
+	// The headers arrive first, so the header chain ends in the child when the invalid block is connected
+	for _, header := range []*BlockHeader{&invalid.BlockHeader, &invalidChild.BlockHeader} {
+		if err := b.AddHeader(header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.AddBlock(&invalid); err == nil {
+		t.Fatal("Connected a block with a double spend")
+	}
+	if entry, err := b.GetIndex(invalidChild.PoW.Hash); err != nil || !entry.Invalid {
+		t.Fatal("Child of an invalid block was not marked invalid")
+	}
+	if b.latestHeader != b.latestBlock {
+		t.Fatal("Header chain still ends in a descendant of an invalid block")
+	}
+	if err := b.AddBlock(&invalidChild); err == nil || b.Height() != 1 {
+		t.Fatal("Connected a child of an invalid block")
+	}
+
+	// The valid branch still becomes the main chain
+	for _, block := range []*Block{valid, child} {
+		if err := b.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.latestBlock != child.PoW.Hash || b.latestHeader != child.PoW.Hash {
+		t.Fatal("Valid branch did not become the main chain")
+	}
+}
+
+func TestShortPublicKey(t *testing.T) {
+	chains, miners := createTestChains(t, 1)
+	bc := chains[0]
+	// Any account id can be derived from a short key, no coins are needed for that
+	shortKey := ed25519.PublicKey{1, 2, 3, 4, 5}
+	attacker := AccountId(sha256.Sum256(shortKey))
+	reward := (*bc.GetUTxOsForUser(miners[0].Id))[0]
+	tx := NewTx(
+		[]TxI{{From: attacker, Output: &reward.Path}},
+		[]TxO{{Value: reward.Value, To: attacker}},
+		map[AccountId]Signature{attacker: {}},
+	)
+	tx.Keys = map[AccountId]ed25519.PublicKey{attacker: shortKey}
+	if err := bc.VerifyTransaction(tx); err == nil {
+		t.Fatal("Accepted a transaction with a short public key")
+	}
+}
+
+func TestOpenFailureClosesDatabase(t *testing.T) {
+	chains, miners := createTestChains(t, 1)
+	bc := chains[0]
+	dbFile := bc.db.Path()
+	// Point the latest block to a block which is not in the index
+	if err := bc.db.Update(func(tx *bolt.Tx) error {
+		unknown := sha256.Sum256([]byte("unknown block"))
+		return bc.bucket(tx, miscBucketName).Put([]byte(latestBlockKey), unknown[:])
+	}); err != nil {
+		t.Fatal(err)
+	}
+	bc.Close()
+
+	params := RegtestParams
+	if _, err := OpenBlockchain(dbFile, miners[0], &params); err == nil {
+		t.Fatal("Opened a chain with an unknown latest block")
+	}
+	// The file lock has to be released
+	db, err := bolt.Open(dbFile, 0666, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
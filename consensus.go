@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Decides how blocks are sealed, which seals are valid and which chain is the main chain.
+// Every network uses the engine set in its ChainParams.
+type ConsensusEngine interface {
+	// Seals a header which is complete apart from the seal. This sets the block hash.
+	// Sealing stops with the error of ctx if it is cancelled.
+	Seal(ctx context.Context, bc *Blockchain, header *BlockHeader) error
+	// Verifies the seal of a header. Whether the target is correct is checked separately.
+	VerifySeal(bc *Blockchain, header *BlockHeader) error
+	// Verifies the parts of the seal which don't depend on the parent, for blocks whose parent is unknown.
+	// The full seal is verified with VerifySeal once the parent arrives.
+	VerifyOrphanSeal(bc *Blockchain, header *BlockHeader) error
+	// Calculates the target a block following the given parent has to use
+	NextTarget(bc *Blockchain, parentHash SHA256Sum) (SHA256Sum, error)
+	// The weight a block adds to its chain. The chain with the most cumulative weight is the main chain.
+	Weight(header *BlockHeader) *big.Int
+}
+
+// SHA-256 proof of work. The block hash has to be smaller than the target.
+// Sealing searches the nonce space with several workers in parallel.
+type PoWEngine struct {
+	// Number of goroutines searching for a nonce. All CPUs are used if it is 0.
+	Workers int
+	// Only the nonces below NonceRange are tried, or all of them if it is 0
+	NonceRange uint64
+}
+
+// Counts the nonces tried by the current or last seal of a chain.
+// Accessed atomically, so the hashrate can be read while mining.
+type hashMeter struct {
+	hashes uint64
+	// Start and end of the seal in Unix nanoseconds
+	started int64
+	stopped int64
+}
+
+// Number of nonces a worker tries between checking for cancellation
+const powBatchSize uint64 = 1 << 12
+
+// Returned by Seal if no nonce in the nonce range meets the target.
+// The header has to be changed, e.g. by rolling the extra nonce of the mining reward transaction.
+var ErrNonceSpaceExhausted = errors.New("No nonce meets the target")
+
+func NewPoWEngine(workers int) *PoWEngine {
+	return &PoWEngine{
+		Workers: workers,
+	}
+}
+
+// Searches a nonce for which the PoW hash meets the target of the header.
+// Worker i tries the nonces i, i+n, i+2n, ... for n workers. Stops with the error of ctx if it is cancelled.
+func (engine *PoWEngine) Seal(ctx context.Context, bc *Blockchain, header *BlockHeader) error {
+	workers := engine.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	binaryHeader := header.Binary()
+	// Engines are shared by all chains of a network, so the hashes are counted per chain
+	meter := &hashMeter{}
+	if bc != nil {
+		meter = &bc.hashMeter
+	}
+	meter.start()
+	defer func() {
+		meter.stop()
+		fmt.Printf("Tried %d nonces at %.0f H/s\n", atomic.LoadUint64(&meter.hashes), meter.rate())
+	}()
+
+	searchCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	found := make(chan *PoW, workers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(first uint64) {
+			defer wg.Done()
+			if pow := engine.search(searchCtx, meter, binaryHeader, header.Target, first, uint64(workers)); pow != nil {
+				found <- pow
+				stop()
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+
+	select {
+	case pow := <-found:
+		header.PoW.Nonce = pow.Nonce
+		header.PoW.Hash = pow.Hash
+		return nil
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ErrNonceSpaceExhausted
+}
+
+// Tries the nonces first, first+step, ... until one meets the target, the nonce range is exhausted or ctx is done
+func (engine *PoWEngine) search(ctx context.Context, meter *hashMeter, binaryHeader []byte, target SHA256Sum, first uint64, step uint64) *PoW {
+	data := make([]byte, len(binaryHeader)+8)
+	copy(data, binaryHeader)
+	nonceRaw := data[len(binaryHeader):]
+
+	var tried uint64
+	for nonce := first; nonce >= first && (engine.NonceRange == 0 || nonce < engine.NonceRange); nonce += step {
+		binary.LittleEndian.PutUint64(nonceRaw, nonce)
+		sum := sha256.Sum256(data)
+		tried++
+		if meetsTarget(sum, target) {
+			// Valid Nonce
+			atomic.AddUint64(&meter.hashes, tried)
+			return &PoW{Nonce: nonce, Hash: sum}
+		}
+		if tried == powBatchSize {
+			atomic.AddUint64(&meter.hashes, tried)
+			tried = 0
+			if ctx.Err() != nil {
+				return nil
+			}
+		}
+	}
+	atomic.AddUint64(&meter.hashes, tried)
+	return nil
+}
+
+func (meter *hashMeter) start() {
+	atomic.StoreUint64(&meter.hashes, 0)
+	atomic.StoreInt64(&meter.stopped, 0)
+	atomic.StoreInt64(&meter.started, time.Now().UnixNano())
+}
+
+func (meter *hashMeter) stop() {
+	atomic.StoreInt64(&meter.stopped, time.Now().UnixNano())
+}
+
+// The hashes per second of the current or last seal
+func (meter *hashMeter) rate() float64 {
+	started := atomic.LoadInt64(&meter.started)
+	if started == 0 {
+		return 0
+	}
+	stopped := atomic.LoadInt64(&meter.stopped)
+	if stopped == 0 {
+		stopped = time.Now().UnixNano()
+	}
+	elapsed := time.Duration(stopped - started)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&meter.hashes)) / elapsed.Seconds()
+}
+
+// The hashes per second of the current or last proof of work sealed by the chain
+func (bc *Blockchain) Hashrate() float64 {
+	return bc.hashMeter.rate()
+}
+
+func (engine *PoWEngine) VerifySeal(bc *Blockchain, header *BlockHeader) error {
+	return header.VerifyPoW(bc.params.MaxTarget)
+}
+
+// The PoW doesn't depend on the parent, so it is verified completely
+func (engine *PoWEngine) VerifyOrphanSeal(bc *Blockchain, header *BlockHeader) error {
+	return engine.VerifySeal(bc, header)
+}
+
+// The expected number of hashes needed to find the PoW of the header
+func (engine *PoWEngine) Weight(header *BlockHeader) *big.Int {
+	return workForTarget(header.Target)
+}
+
+// The expected number of hashes needed to find a PoW hash below the target
+func workForTarget(target SHA256Sum) *big.Int {
+	maxHash := new(big.Int).Lsh(big.NewInt(1), 256)
+	divisor := new(big.Int).SetBytes(target[:])
+	divisor.Add(divisor, big.NewInt(1))
+	return maxHash.Div(maxHash, divisor)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPoWEngine(t *testing.T) {
+	chains, _ := createTestChains(t, 1)
+	bc := chains[0]
+	engine := NewPoWEngine(2)
+
+	block, err := bc.MineNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.VerifySeal(bc, &block.BlockHeader); err != nil {
+		t.Fatal(err)
+	}
+	block.PoW.Nonce++
+	if err := engine.VerifySeal(bc, &block.BlockHeader); err == nil {
+		t.Fatal("Accepted a seal with the wrong nonce")
+	}
+	if err := engine.Seal(context.Background(), bc, &block.BlockHeader); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.VerifySeal(bc, &block.BlockHeader); err != nil {
+		t.Fatal(err)
+	}
+
+	// Harder targets weigh more
+	easy := BlockHeader{Target: SHA256Sum{0x7F}}
+	hard := BlockHeader{Target: SHA256Sum{0x0F}}
+	if engine.Weight(&hard).Cmp(engine.Weight(&easy)) <= 0 {
+		t.Fatal("Harder target does not weigh more")
+	}
+}
+
+func TestPoWCancellation(t *testing.T) {
+	params := RegtestParams
+	engine := NewPoWEngine(4)
+	params.Engine = engine
+	chains, _ := createTestChainsWithParams(t, 2, &params)
+	block := NewBlock()
+	block.LastBlockHash = nullHash
+	// No hash is below the zero target
+	block.Target = emptyHash
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := engine.Seal(ctx, chains[0], &block.BlockHeader); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline error, got %v", err)
+	}
+	if chains[0].Hashrate() <= 0 {
+		t.Fatal("No hashrate reported")
+	}
+	// The engine is shared, but the hashrate belongs to the chain which sealed
+	if chains[1].Hashrate() != 0 {
+		t.Fatal("Hashrate reported for a chain which didn't seal")
+	}
+}
+
+// Stalls sealing on one chain until it is cancelled. Signals `sealing` whenever it starts stalling.
+type stallingEngine struct {
+	*PoWEngine
+	stalled *Blockchain
+	sealing chan struct{}
+}
+
+func (engine *stallingEngine) Seal(ctx context.Context, bc *Blockchain, header *BlockHeader) error {
+	if bc != engine.stalled {
+		return engine.PoWEngine.Seal(ctx, bc, header)
+	}
+	select {
+	case engine.sealing <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestMiningStopsOnNewBlock(t *testing.T) {
+	params := RegtestParams
+	engine := &stallingEngine{PoWEngine: NewPoWEngine(1), sealing: make(chan struct{}, 1)}
+	params.Engine = engine
+	chains, _ := createTestChainsWithParams(t, 2, &params)
+	nodes := make([]*Node, len(chains))
+	for i, bc := range chains {
+		nodes[i] = NewNode(bc, "127.0.0.1:0")
+		if err := nodes[i].Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer nodes[i].Stop()
+	}
+	connectLine(t, nodes)
+
+	engine.stalled = nodes[0].bc
+	mined := make(chan error, 1)
+	go func() {
+		_, err := nodes[0].MineNextContext(context.Background())
+		mined <- err
+	}()
+	<-engine.sealing
+
+	// A competing block arrives while mining
+	if _, err := nodes[1].MineNext(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-mined:
+		if err != context.Canceled {
+			t.Fatalf("Expected mining to be cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Mining did not stop")
+	}
+}
+
+func TestTransactionsStayInMempoolWhileMining(t *testing.T) {
+	params := RegtestParams
+	engine := &stallingEngine{PoWEngine: NewPoWEngine(1), sealing: make(chan struct{}, 1)}
+	params.Engine = engine
+	chains, miners := createTestChainsWithParams(t, 1, &params)
+	node := NewNode(chains[0], "127.0.0.1:0")
+	engine.stalled = node.bc
+	receiver, _ := NewAccount()
+	tx, err := node.Send(miners[0], receiver.Id, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mined := make(chan error, 1)
+	go func() {
+		_, err := node.MineNextContext(ctx)
+		mined <- err
+	}()
+	<-engine.sealing
+	node.chainMu.Lock()
+	if node.bc.mempool.Find(tx.Hash()) == nil {
+		t.Error("Transaction left the mempool while its block is sealed")
+	}
+	// The outputs it spends are still taken, so a double spend is refused
+	if _, err := node.bc.Send(miners[0], receiver.Id, 10, 1); err == nil {
+		t.Error("Sent a transaction spending the same output")
+	}
+	node.chainMu.Unlock()
+
+	cancel()
+	if err := <-mined; err != context.Canceled {
+		t.Fatalf("Expected mining to be cancelled, got %v", err)
+	}
+	if node.bc.mempool.Count() != 1 {
+		t.Fatal("Transaction was lost when mining was cancelled")
+	}
+}
+
+func TestExtraNonce(t *testing.T) {
+	params := RegtestParams
+	// Half of all hashes meet the regtest target, so a single nonce is often not enough
+	params.Engine = &PoWEngine{Workers: 1, NonceRange: 1}
+	chains, _ := createTestChainsWithParams(t, 1, &params)
+	bc := chains[0]
+
+	rolled := false
+	for i := 0; i < 20; i++ {
+		block, err := bc.MineNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.PoW.Nonce != 0 {
+			t.Fatalf("Nonce %d is out of range", block.PoW.Nonce)
+		}
+		if block.Transactions[0].Coinbase.ExtraNonce > 0 {
+			rolled = true
+		}
+	}
+	if !rolled {
+		t.Fatal("Extra nonce was never rolled")
+	}
+}
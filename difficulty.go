@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+const (
+	// Number of blocks the median time past is calculated over
+	medianTimeSpan int = 11
+	// How far a block timestamp may be ahead of the local clock
+	maxFutureDrift time.Duration = 2 * time.Hour
+)
+
+func targetToBig(target SHA256Sum) *big.Int {
+	return new(big.Int).SetBytes(target[:])
+}
+
+func bigToTarget(value *big.Int) SHA256Sum {
+	var target SHA256Sum
+	value.FillBytes(target[:])
+	return target
+}
+
+// Calculates the target a block following the given parent has to use
+func (bc *Blockchain) NextTarget(parentHash SHA256Sum) (SHA256Sum, error) {
+	return bc.params.Engine.NextTarget(bc, parentHash)
+}
+
+// Every RetargetInterval blocks the target is scaled by the ratio of the time the last interval
+// actually took to the time it should have taken, clamped to MaxRetargetFactor.
+func (engine *PoWEngine) NextTarget(bc *Blockchain, parentHash SHA256Sum) (SHA256Sum, error) {
+	params := bc.params
+	if parentHash == nullHash {
+		return params.MaxTarget, nil
+	}
+	parent, err := bc.GetHeader(parentHash)
+	if err != nil {
+		return emptyHash, err
+	}
+	parentIndex, err := bc.GetIndex(parentHash)
+	if err != nil {
+		return emptyHash, err
+	}
+	height := parentIndex.Height + 1
+	if params.NoRetargeting || height%params.RetargetInterval != 0 {
+		return parent.Target, nil
+	}
+
+	// Find the first block of the interval
+	first := parent
+	for i := uint64(1); i < params.RetargetInterval; i++ {
+		if first, err = bc.GetHeader(first.LastBlockHash); err != nil {
+			return emptyHash, err
+		}
+	}
+
+	expected := int64(params.TargetBlockTime/time.Second) * int64(params.RetargetInterval-1)
+	actual := parent.Timestamp - first.Timestamp
+	if actual < 0 {
+		actual = 0
+	}
+
+	previous := targetToBig(parent.Target)
+	next := new(big.Int).Mul(previous, big.NewInt(actual))
+	next.Div(next, big.NewInt(expected))
+
+	lowest := new(big.Int).Div(previous, big.NewInt(params.MaxRetargetFactor))
+	highest := new(big.Int).Mul(previous, big.NewInt(params.MaxRetargetFactor))
+	if next.Cmp(lowest) < 0 {
+		next = lowest
+	}
+	if next.Cmp(highest) > 0 {
+		next = highest
+	}
+	if next.Cmp(targetToBig(params.MaxTarget)) > 0 {
+		return params.MaxTarget, nil
+	}
+	return bigToTarget(next), nil
+}
+
+// Calculates the median timestamp of the last medianTimeSpan blocks up to and including the given block.
+// A block following it needs a timestamp above the median.
+func (bc *Blockchain) MedianTimePast(blockHash SHA256Sum) (int64, error) {
+	timestamps := make([]int64, 0, medianTimeSpan)
+	for len(timestamps) < medianTimeSpan && blockHash != nullHash {
+		header, err := bc.GetHeader(blockHash)
+		if err != nil {
+			return 0, err
+		}
+		timestamps = append(timestamps, header.Timestamp)
+		blockHash = header.LastBlockHash
+	}
+	if len(timestamps) == 0 {
+		return 0, errors.New("No blocks to calculate the median time past of")
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	return timestamps[len(timestamps)/2], nil
+}
+
+// Verifies the parts of a header which depend on its position in the chain
+func (bc *Blockchain) verifyHeaderContext(header *BlockHeader) error {
+	expectedTarget, err := bc.NextTarget(header.LastBlockHash)
+	if err != nil {
+		return err
+	}
+	if header.Target != expectedTarget {
+		return errors.New(fmt.Sprintf("Block invalid! Target %x does not match the expected target %x.", header.Target, expectedTarget))
+	}
+
+	if header.LastBlockHash != nullHash {
+		medianTimePast, err := bc.MedianTimePast(header.LastBlockHash)
+		if err != nil {
+			return err
+		}
+		if header.Timestamp <= medianTimePast {
+			return errors.New(fmt.Sprintf("Block invalid! Timestamp %d is not after the median time past %d.", header.Timestamp, medianTimePast))
+		}
+	}
+	if header.Timestamp > now().Add(maxFutureDrift).Unix() {
+		return errors.New(fmt.Sprintf("Block invalid! Timestamp %d is too far in the future.", header.Timestamp))
+	}
+	return nil
+}
+
+// Checks whether a hash meets a target
+func meetsTarget(hash SHA256Sum, target SHA256Sum) bool {
+	return bytes.Compare(target[:], hash[:]) > 0
+}
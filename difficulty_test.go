@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+// Mines blocks with timestamps `spacing` apart, starting after the latest block
+func mineSpaced(t *testing.T, bc *Blockchain, count int, spacing time.Duration) {
+	latest, err := bc.GetHeader(bc.latestBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := time.Unix(latest.Timestamp, 0)
+	now = func() time.Time {
+		return clock
+	}
+	defer func() {
+		now = time.Now
+	}()
+	for i := 0; i < count; i++ {
+		clock = clock.Add(spacing)
+		if _, err := bc.MineNext(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRetarget(t *testing.T) {
+	params := RegtestParams
+	params.NoRetargeting = false
+	chains, _ := createTestChainsWithParams(t, 1, &params)
+	bc := chains[0]
+
+	// The first interval starts at the fixed genesis timestamp, so start measuring at the first retarget
+	mineSpaced(t, bc, int(params.RetargetInterval-bc.Height()), params.TargetBlockTime)
+
+	// The next interval takes half the expected time
+	mineSpaced(t, bc, int(params.RetargetInterval)-1, params.TargetBlockTime/2)
+	target, err := bc.NextTarget(bc.latestBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := new(big.Int).Div(targetToBig(params.MaxTarget), big.NewInt(2))
+	if targetToBig(target).Cmp(expected) != 0 {
+		t.Fatalf("Expected target %x, got %x", bigToTarget(expected), target)
+	}
+
+	// Blocks within the interval keep the target
+	mineSpaced(t, bc, int(params.RetargetInterval)-1, 0)
+	header, _ := bc.GetHeader(bc.latestBlock)
+	if header.Target != target {
+		t.Fatal("Target changed within a retarget interval")
+	}
+
+	// Without any time passing the adjustment is clamped
+	mineSpaced(t, bc, 1, 0)
+	clamped, _ := bc.NextTarget(bc.latestBlock)
+	expected.Div(expected, big.NewInt(params.MaxRetargetFactor))
+	if targetToBig(clamped).Cmp(expected) != 0 {
+		t.Fatalf("Expected clamped target %x, got %x", bigToTarget(expected), clamped)
+	}
+}
+
+func TestWrongTargetIsRejected(t *testing.T) {
+	chains, _ := createTestChains(t, 2)
+	a, b := chains[0], chains[1]
+	block, err := b.MineNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make the block easier than required and mine it again
+	block.Target = SHA256Sum{0xFF}
+	sealBlock(t, b, block)
+	if err := a.VerifyBlock(block); err == nil {
+		t.Fatal("Accepted block with a target easier than allowed")
+	}
+}
+
+func TestTimestampValidation(t *testing.T) {
+	chains, _ := createTestChains(t, 2)
+	a, b := chains[0], chains[1]
+	mineSpaced(t, a, medianTimeSpan, time.Minute)
+	mineSpaced(t, b, medianTimeSpan, time.Minute)
+	medianTimePast, err := a.MedianTimePast(a.latestBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := b.MineNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both chains have the same timestamps, but different blocks, so only a's context is used
+	block.LastBlockHash = a.latestBlock
+	block.Timestamp = medianTimePast
+	sealBlock(t, a, block)
+	if err := a.VerifyBlock(block); err == nil {
+		t.Fatal("Accepted block with a timestamp not after the median time past")
+	}
+
+	block.Timestamp = medianTimePast + 1
+	sealBlock(t, a, block)
+	if err := a.VerifyBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	block.Timestamp = time.Now().Add(maxFutureDrift + time.Minute).Unix()
+	sealBlock(t, a, block)
+	if err := a.VerifyBlock(block); err == nil {
+		t.Fatal("Accepted block with a timestamp too far in the future")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// A mempool transaction considered for a block
+type candidate struct {
+	tx  *Tx
+	fee uint64
+	// Serialized size in bytes
+	size int
+}
+
+// Fee per byte
+func (c *candidate) feeRate() float64 {
+	return float64(c.fee) / float64(c.size)
+}
+
+// Selects transactions from the mempool, highest fee rate first, until the block limits are reached.
+// `reserved` bytes of the block are kept free for the header and mining reward transaction.
+// The selected transactions stay in the mempool until a block containing them is connected.
+// Transactions which became invalid are dropped from the mempool. Transactions which conflict with one
+// paying a higher fee rate are left out, they become invalid once the block is connected.
+// Returns the selected transactions for a block at the given height and the sum of their fees.
+func (bc *Blockchain) selectTransactions(height uint64, reserved int) ([]*Tx, uint64) {
+	pending := bc.mempool.Transactions()
+	candidates := make([]*candidate, 0, len(pending))
+	for _, tx := range pending {
+		fee, err := bc.verifyTransaction(tx, make(map[TxOPath]bool), height)
+		if err != nil {
+			fmt.Printf("Dropping transaction '%x': %s\n", tx.Hash(), err)
+			bc.mempool.Remove(tx.Hash())
+			continue
+		}
+		candidates = append(candidates, &candidate{
+			tx:   tx,
+			fee:  fee,
+			size: len(tx.Serialize()),
+		})
+	}
+	// Stable, so transactions paying the same rate stay in the order they arrived in
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].feeRate() > candidates[j].feeRate()
+	})
+
+	selected := make([]*Tx, 0, len(candidates))
+	spent := make(map[TxOPath]bool)
+	var fees uint64
+	// A transaction is smaller within a block than on its own, as the encoding of the types is shared
+	size := reserved
+	for _, c := range candidates {
+		if len(selected)+1 >= bc.params.MaxBlockTransactions || size+c.size > bc.params.MaxBlockSize {
+			continue
+		}
+		conflicting := false
+		for _, in := range c.tx.Inputs {
+			if spent[*in.Output] {
+				conflicting = true
+				break
+			}
+		}
+		if conflicting {
+			fmt.Printf("Leaving out transaction '%x': Conflicts with a transaction paying a higher fee rate\n", c.tx.Hash())
+			continue
+		}
+		for _, in := range c.tx.Inputs {
+			spent[*in.Output] = true
+		}
+		selected = append(selected, c.tx)
+		fees += c.fee
+		size += c.size
+	}
+	return selected, fees
+}
+
+// An upper bound for the size of a block containing only a mining reward transaction paying `recipients` accounts.
+// The header fields and the reward are set to their largest encodings, as they are not known before mining.
+func coinbaseBlockSize(height uint64, recipients int) int {
+	block := NewBlock()
+	block.LastBlockHash = nullHash
+	block.MerkleRoot = nullHash
+	block.Target = nullHash
+	block.Timestamp = math.MaxInt64
+	block.PoW = &PoW{
+		Nonce: math.MaxUint64,
+		Hash:  nullHash,
+	}
+	// Only set on proof of authority networks
+	block.Authority = &AuthoritySeal{
+		Signer:    AccountId(nullHash),
+		Vote:      &ValidatorVote{Validator: make(ed25519.PublicKey, ed25519.PublicKeySize), Add: true},
+		Signature: make(Signature, ed25519.SignatureSize),
+	}
+	coinbase := NewCoinbaseTx(height, AccountId(nullHash), math.MaxUint64)
+	for len(coinbase.Outputs) < recipients {
+		coinbase.Outputs = append(coinbase.Outputs, coinbase.Outputs[0])
+	}
+	coinbase.Coinbase.ExtraNonce = math.MaxUint64
+	block.AddTransaction(coinbase)
+	return len(block.Serialize())
+}
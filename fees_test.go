@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+func TestFees(t *testing.T) {
+	chains, miners := createTestChains(t, 2)
+	a, b := chains[0], chains[1]
+	alice, _ := NewAccount()
+	bob, _ := NewAccount()
+
+	reward := (*a.GetUTxOsForUser(miners[0].Id))[0]
+	lowFee := spendOutput(miners[0], reward, alice.Id, 1)
+	highFee := spendOutput(miners[0], reward, bob.Id, 10)
+	tooMuch := spendOutput(miners[0], reward, bob.Id, 0)
+	tooMuch.Outputs[0].Value++
+	tooMuch.Signatures[miners[0].Id] = miners[0].Sign(tooMuch)
+	if err := a.VerifyTransaction(tooMuch); err == nil {
+		t.Fatal("Accepted transaction spending more than its inputs")
+	}
+
+	// The conflicting transaction paying the higher fee rate wins
+	a.mempool.Push(lowFee)
+	a.mempool.Push(highFee)
+	block, err := a.MineNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Transactions) != 2 || block.Transactions[1].Hash() != highFee.Hash() {
+		t.Fatal("Transaction with the higher fee rate was not mined")
+	}
+	if reward := block.Transactions[0].Outputs[0].Value; reward != a.params.InitialReward+10 {
+		t.Fatalf("Expected mining reward %d, got %d", a.params.InitialReward+10, reward)
+	}
+	if balance := a.GetUTxOsForUser(miners[0].Id).Balance(); balance != a.params.InitialReward+10 {
+		t.Fatalf("Expected miner balance %d, got %d", a.params.InitialReward+10, balance)
+	}
+
+	// Claiming more than the fees
+	block.Transactions[0].Outputs[0].Value++
+	sealBlock(t, b, block)
+	if err := b.VerifyBlock(block); err == nil {
+		t.Fatal("Accepted block claiming more than the reward and fees")
+	}
+}
+
+func TestBlockLimits(t *testing.T) {
+	chains, miners := createTestChains(t, 1)
+	a := chains[0]
+	receiver, _ := NewAccount()
+	for i := 0; i < 4; i++ {
+		if _, err := a.MineNext(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	txs := make([]*Tx, 0)
+	for i, utxo := range *a.GetUTxOsForUser(miners[0].Id) {
+		txs = append(txs, spendOutput(miners[0], utxo, receiver.Id, uint64(i+1)))
+	}
+
+	a.params.MaxBlockTransactions = 3
+	for _, tx := range txs {
+		a.mempool.Push(tx)
+	}
+	block, err := a.MineNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Transactions) != 3 || block.Transactions[1] != txs[4] || block.Transactions[2] != txs[3] {
+		t.Fatal("Block does not contain the transactions with the highest fees")
+	}
+	if a.mempool.Count() != 3 {
+		t.Fatalf("Expected 3 transactions left in the mempool, got %d", a.mempool.Count())
+	}
+
+	// A block exceeding the limits is rejected
+	if err := a.verifyBlockStructure(block); err != nil {
+		t.Fatal(err)
+	}
+	a.params.MaxBlockTransactions = 2
+	if err := a.verifyBlockStructure(block); err == nil {
+		t.Fatal("Accepted block with too many transactions")
+	}
+	a.params.MaxBlockTransactions = RegtestParams.MaxBlockTransactions
+
+	// Room for exactly one more transaction
+	a.params.MaxBlockSize = coinbaseBlockSize(a.Height()+1, 1) + len(txs[0].Serialize())
+	if block, err = a.MineNext(); err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Transactions) != 2 || a.mempool.Count() != 2 {
+		t.Fatal("Block size limit was not respected")
+	}
+	if size := len(block.Serialize()); size > a.params.MaxBlockSize {
+		t.Fatalf("Block of %d bytes exceeds the limit of %d", size, a.params.MaxBlockSize)
+	}
+}
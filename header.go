@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The part of a block which is covered by the proof of work.
+// Headers can be validated without the transactions of the block.
+type BlockHeader struct {
+	LastBlockHash SHA256Sum
+	// Merkle root over the transaction hashes of the block
+	MerkleRoot SHA256Sum
+	// Unix time in seconds at which the block was mined
+	Timestamp int64
+	// The PoW hash has to be smaller than the target
+	Target SHA256Sum
+	PoW    *PoW
+	// Only set on proof of authority networks
+	Authority *AuthoritySeal
+}
+
+// Get the binary representation of the header for hashing purposes
+// Last block hash must be set before.
+func (header *BlockHeader) Binary() []byte {
+	if header.LastBlockHash == emptyHash {
+		// Make sure LastBlockHash is set before hashing
+		panic("Tried getting binary of block without last block hash")
+	}
+	timestampRaw := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestampRaw, uint64(header.Timestamp))
+
+	var binaryHeader []byte
+	binaryHeader = append(binaryHeader, header.MerkleRoot[:]...)
+	binaryHeader = append(binaryHeader, header.LastBlockHash[:]...)
+	binaryHeader = append(binaryHeader, timestampRaw...)
+	binaryHeader = append(binaryHeader, header.Target[:]...)
+	if header.Authority != nil {
+		binaryHeader = append(binaryHeader, header.Authority.Binary()...)
+	}
+	return binaryHeader
+}
+
+// Verifies that the PoW hash is correct and meets the target, which may not be easier than `maxTarget`.
+// Whether the target itself is correct depends on the chain and is checked separately.
+func (header *BlockHeader) VerifyPoW(maxTarget SHA256Sum) error {
+	nonceRaw := make([]byte, 8)
+	binary.LittleEndian.PutUint64(nonceRaw, header.PoW.Nonce)
+	blockHash := sha256.Sum256(append(header.Binary(), nonceRaw...))
+	if blockHash != header.PoW.Hash {
+		return errors.New(fmt.Sprintf("Block invalid! The PoW hash does not match the header."))
+	}
+	if bytes.Compare(header.Target[:], maxTarget[:]) > 0 {
+		return errors.New(fmt.Sprintf("Block invalid! The target is easier than allowed."))
+	}
+	if !meetsTarget(blockHash, header.Target) {
+		// Invalid PoW
+		return errors.New(fmt.Sprintf("Block invalid! The PoW is not valid."))
+	}
+	return nil
+}
+
+func (header *BlockHeader) Serialize() []byte {
+	buf := bytes.Buffer{}
+	encoder := gob.NewEncoder(&buf)
+	err := encoder.Encode(header)
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func BlockHeaderDeserialize(raw []byte) *BlockHeader {
+	var header BlockHeader
+	buf := bytes.Buffer{}
+	buf.Write(raw)
+	decoder := gob.NewDecoder(&buf)
+	err := decoder.Decode(&header)
+	if err != nil {
+		panic(err)
+	}
+	return &header
+}
+
+// Stores and indexes a header.
+// Fails if the parent header is unknown or the seal or target are invalid.
+// The header chain switches to the header if it has the most cumulative work.
+// The block body can be added later using AddBlock.
+func (bc *Blockchain) AddHeader(header *BlockHeader) error {
+	if header.PoW == nil || header.LastBlockHash == emptyHash {
+		return errors.New("Header is malformed")
+	}
+	if err := bc.params.Engine.VerifySeal(bc, header); err != nil {
+		return err
+	}
+	if header.LastBlockHash != nullHash {
+		if _, err := bc.GetIndex(header.LastBlockHash); err != nil {
+			return errors.New(fmt.Sprintf("Parent block '%x' is unknown", header.LastBlockHash))
+		}
+	}
+	if err := bc.verifyHeaderContext(header); err != nil {
+		return err
+	}
+	return bc.db.Update(func(t *bolt.Tx) error {
+		_, err := bc.indexHeader(t, header)
+		return err
+	})
+}
+
+func (bc *Blockchain) GetHeader(powHash SHA256Sum) (*BlockHeader, error) {
+	var header *BlockHeader
+	err := bc.db.View(func(t *bolt.Tx) error {
+		bucket := bc.bucket(t, headersBucketName)
+		raw := bucket.Get(powHash[:])
+		if raw == nil {
+			return errors.New("Header '" + fmt.Sprintf("%x", powHash) + "' not found!")
+		}
+		header = BlockHeaderDeserialize(raw)
+		return nil
+	})
+	return header, err
+}
+
+// Returns the hashes of all headers in the header chain, starting with the genesis block.
+// The header chain is the chain with the most work, regardless of whether the bodies are known.
+func (bc *Blockchain) HeaderChain() []SHA256Sum {
+	return bc.chainFrom(bc.latestHeader)
+}
+
+// Returns the hashes of all headers from the genesis block up to a given header
+func (bc *Blockchain) chainFrom(tip SHA256Sum) []SHA256Sum {
+	hashes := make([]SHA256Sum, 0)
+	bc.db.View(func(t *bolt.Tx) error {
+		headersBucket := bc.bucket(t, headersBucketName)
+		currBlockHash := tip
+		for currBlockHash != nullHash {
+			hashes = append(hashes, currBlockHash)
+			currBlockHash = BlockHeaderDeserialize(headersBucket.Get(currBlockHash[:])).LastBlockHash
+		}
+		return nil
+	})
+	// Reverse, so the genesis block comes first
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+	return hashes
+}
+
+func (bc *Blockchain) putHeader(t *bolt.Tx, header *BlockHeader) {
+	bucket := bc.bucket(t, headersBucketName)
+	bucket.Put(header.PoW.Hash[:], header.Serialize())
+}
+
+func (bc *Blockchain) setLatestHeader(t *bolt.Tx, lh SHA256Sum) error {
+	miscBucket := bc.bucket(t, miscBucketName)
+	if miscBucket == nil {
+		return errors.New("Unable to set latest header! Misc bucket not found.")
+	}
+	return miscBucket.Put([]byte(latestHeaderKey), lh[:])
+}
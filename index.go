@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Metadata kept for every known header, including headers of blocks on side branches
+type BlockIndex struct {
+	Height uint64
+	// Cumulative work of the chain up to and including this block
+	ChainWork *big.Int
+	// Set if the transactions of the block or of one of its ancestors turned out to be invalid when connecting it
+	Invalid bool
+}
+
+func (entry *BlockIndex) Serialize() []byte {
+	buf := bytes.Buffer{}
+	encoder := gob.NewEncoder(&buf)
+	err := encoder.Encode(entry)
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func BlockIndexDeserialize(raw []byte) *BlockIndex {
+	var entry BlockIndex
+	buf := bytes.Buffer{}
+	buf.Write(raw)
+	decoder := gob.NewDecoder(&buf)
+	err := decoder.Decode(&entry)
+	if err != nil {
+		panic(err)
+	}
+	return &entry
+}
+
+func (bc *Blockchain) GetIndex(powHash SHA256Sum) (*BlockIndex, error) {
+	var entry *BlockIndex
+	err := bc.db.View(func(t *bolt.Tx) error {
+		entry = bc.getIndex(t, powHash)
+		if entry == nil {
+			return errors.New("Index entry for '" + fmt.Sprintf("%x", powHash) + "' not found!")
+		}
+		return nil
+	})
+	return entry, err
+}
+
+func (bc *Blockchain) getIndex(t *bolt.Tx, powHash SHA256Sum) *BlockIndex {
+	raw := bc.bucket(t, indexBucketName).Get(powHash[:])
+	if raw == nil {
+		return nil
+	}
+	return BlockIndexDeserialize(raw)
+}
+
+// The height of a block with the given parent
+func (bc *Blockchain) childHeight(parentHash SHA256Sum) (uint64, error) {
+	if parentHash == nullHash {
+		return 0, nil
+	}
+	parent, err := bc.GetIndex(parentHash)
+	if err != nil {
+		return 0, err
+	}
+	return parent.Height + 1, nil
+}
+
+// Marks a block and all its known descendants as invalid, so none of them becomes part of the main chain.
+// If the header chain ended in one of them, it falls back to the valid header with the most work.
+func (bc *Blockchain) markInvalid(powHash SHA256Sum) error {
+	return bc.db.Update(func(t *bolt.Tx) error {
+		if bc.getIndex(t, powHash) == nil {
+			return errors.New("Index entry for '" + fmt.Sprintf("%x", powHash) + "' not found!")
+		}
+		// Headers only link to their parent, so find the children of all headers first.
+		// Invalid blocks are rare, so this is cheaper than keeping a child index.
+		children := make(map[SHA256Sum][]SHA256Sum)
+		bc.bucket(t, headersBucketName).ForEach(func(k, v []byte) error {
+			var hash SHA256Sum
+			copy(hash[:], k)
+			parent := BlockHeaderDeserialize(v).LastBlockHash
+			children[parent] = append(children[parent], hash)
+			return nil
+		})
+
+		indexBucket := bc.bucket(t, indexBucketName)
+		invalid := make(map[SHA256Sum]bool)
+		pending := []SHA256Sum{powHash}
+		for len(pending) > 0 {
+			hash := pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+			entry := bc.getIndex(t, hash)
+			if entry == nil || invalid[hash] {
+				continue
+			}
+			entry.Invalid = true
+			if err := indexBucket.Put(hash[:], entry.Serialize()); err != nil {
+				return err
+			}
+			invalid[hash] = true
+			pending = append(pending, children[hash]...)
+		}
+
+		if invalid[bc.latestHeader] {
+			return bc.resetLatestHeader(t)
+		}
+		return nil
+	})
+}
+
+// Makes the valid header with the most work the latest header. Called after the latest header became invalid.
+func (bc *Blockchain) resetLatestHeader(t *bolt.Tx) error {
+	// The latest block is valid, so prefer it if another header has as much work
+	best := bc.latestBlock
+	var bestWork *big.Int
+	if best != nullHash {
+		bestWork = bc.getIndex(t, best).ChainWork
+	}
+	err := bc.bucket(t, indexBucketName).ForEach(func(k, v []byte) error {
+		entry := BlockIndexDeserialize(v)
+		if !entry.Invalid && (bestWork == nil || entry.ChainWork.Cmp(bestWork) > 0) {
+			copy(best[:], k)
+			bestWork = entry.ChainWork
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := bc.setLatestHeader(t, best); err != nil {
+		return err
+	}
+	bc.latestHeader = best
+	return nil
+}
+
+// Stores a header and creates its index entry.
+// The parent has to be indexed already. If the header is indexed already, the existing entry is returned.
+func (bc *Blockchain) indexHeader(t *bolt.Tx, header *BlockHeader) (*BlockIndex, error) {
+	if entry := bc.getIndex(t, header.PoW.Hash); entry != nil {
+		return entry, nil
+	}
+
+	entry := &BlockIndex{
+		Height:    0,
+		ChainWork: bc.params.Engine.Weight(header),
+	}
+	// Descendants of invalid blocks are invalid as well
+	if header.LastBlockHash == nullHash {
+		if header.PoW.Hash != bc.params.GenesisHash {
+			return nil, errors.New(fmt.Sprintf("Genesis block does not match the %s genesis block", bc.params.Name))
+		}
+	} else {
+		parent := bc.getIndex(t, header.LastBlockHash)
+		if parent == nil {
+			return nil, errors.New(fmt.Sprintf("Parent block '%x' is unknown", header.LastBlockHash))
+		}
+		entry.Height = parent.Height + 1
+		entry.ChainWork.Add(entry.ChainWork, parent.ChainWork)
+		entry.Invalid = parent.Invalid
+	}
+
+	bc.putHeader(t, header)
+	bc.bucket(t, indexBucketName).Put(header.PoW.Hash[:], entry.Serialize())
+
+	// The header chain always follows the most work on a valid chain
+	if !entry.Invalid && (bc.latestHeader == nullHash || entry.ChainWork.Cmp(bc.getIndex(t, bc.latestHeader).ChainWork) > 0) {
+		if err := bc.setLatestHeader(t, header.PoW.Hash); err != nil {
+			return nil, err
+		}
+		bc.latestHeader = header.PoW.Hash
+	}
+	return entry, nil
+}
+
+// Finds the paths between two tips and their common ancestor.
+// The blocks to disconnect are ordered from the old tip backwards,
+// the blocks to connect are ordered from the fork point forwards.
+func (bc *Blockchain) forkPaths(oldTip SHA256Sum, newTip SHA256Sum) ([]SHA256Sum, []SHA256Sum, error) {
+	disconnect := make([]SHA256Sum, 0)
+	connect := make([]SHA256Sum, 0)
+	err := bc.db.View(func(t *bolt.Tx) error {
+		headersBucket := bc.bucket(t, headersBucketName)
+		parent := func(hash SHA256Sum) SHA256Sum {
+			return BlockHeaderDeserialize(headersBucket.Get(hash[:])).LastBlockHash
+		}
+
+		newIndex := bc.getIndex(t, newTip)
+		if newIndex == nil {
+			return errors.New(fmt.Sprintf("Block '%x' is not indexed", newTip))
+		}
+		if oldTip == nullHash {
+			// Everything up to the new tip is connected
+			for hash := newTip; hash != nullHash; hash = parent(hash) {
+				connect = append(connect, hash)
+			}
+			return nil
+		}
+		oldHeight := bc.getIndex(t, oldTip).Height
+		newHeight := newIndex.Height
+
+		for newHeight > oldHeight {
+			connect = append(connect, newTip)
+			newTip = parent(newTip)
+			newHeight--
+		}
+		for oldHeight > newHeight {
+			disconnect = append(disconnect, oldTip)
+			oldTip = parent(oldTip)
+			oldHeight--
+		}
+		for oldTip != newTip {
+			disconnect = append(disconnect, oldTip)
+			connect = append(connect, newTip)
+			oldTip = parent(oldTip)
+			newTip = parent(newTip)
+		}
+		return nil
+	})
+	// Reverse, so the block after the fork point comes first
+	for i, j := 0, len(connect)-1; i < j; i, j = i+1, j-1 {
+		connect[i], connect[j] = connect[j], connect[i]
+	}
+	return disconnect, connect, err
+}
@@ -1,18 +1,117 @@
 package main
 
 import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/urfave/cli/v2"
-	//"net/http"
+	"io"
 	"os"
+	"os/signal"
+	"strings"
 )
 
 func main() {
 	app := &cli.App{
 		Name:  "goblockchain",
 		Usage: "Interface for running a blockchain node",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "listen",
+				Usage: "Run as a network node accepting peer connections on `ADDR`",
+			},
+			&cli.StringSliceFlag{
+				Name:  "peer",
+				Usage: "Connect to the node at `ADDR` (may be repeated)",
+			},
+			&cli.StringFlag{
+				Name:  "sync",
+				Usage: "Download the chain from the node at `ADDR` instead of mining a new genesis block",
+			},
+			&cli.BoolFlag{
+				Name:  "headers-first",
+				Usage: "Validate the header chain before downloading block bodies from all peers in parallel",
+			},
+			&cli.StringFlag{
+				Name:  "network",
+				Value: "mainnet",
+				Usage: "Use the chain parameters of `NETWORK` (mainnet, testnet or regtest)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "validator",
+				Usage: "Run a proof of authority network named by --network with the hex encoded validator public key `KEY` (may be repeated)",
+			},
+			&cli.IntFlag{
+				Name:  "workers",
+				Usage: "Mine with `N` goroutines (default: one per CPU)",
+			},
+			&cli.BoolFlag{
+				Name:  "mine",
+				Usage: "Keep mining blocks while running as a network node. Control the miner with 'mine start|stop|status' on stdin",
+			},
+			&cli.Uint64Flag{
+				Name:  "restart-fee",
+				Value: 10,
+				Usage: "Restart mining with a new block when a transaction paying at least `FEE` arrives",
+			},
+			&cli.StringFlag{
+				Name:  "api",
+				Usage: "Serve the HTTP API for external miners and miner control on `ADDR`",
+			},
+			&cli.StringFlag{
+				Name:  "pool",
+				Usage: "Run a mining pool for workers on `ADDR`, paying the mining reward in proportion to their shares",
+			},
+			&cli.Uint64Flag{
+				Name:  "share-factor",
+				Value: 256,
+				Usage: "Make pool shares `N` times easier than blocks",
+			},
+			&cli.StringFlag{
+				Name:  "pool-worker",
+				Usage: "Mine as a worker of the pool at `ADDR`, paid to the account, instead of running a node",
+			},
+		},
 		Action: func(c *cli.Context) error {
-			start("blockchain.db", "account")
+			var params *ChainParams
+			if c.IsSet("validator") {
+				var validators []ed25519.PublicKey
+				for _, key := range c.StringSlice("validator") {
+					pubKey, err := hex.DecodeString(key)
+					if err != nil || len(pubKey) != ed25519.PublicKeySize {
+						return errors.New(fmt.Sprintf("Invalid validator key '%s'", key))
+					}
+					validators = append(validators, pubKey)
+				}
+				params = NewPoAParams(c.String("network"), validators)
+			} else {
+				var err error
+				if params, err = NetworkParams(c.String("network")); err != nil {
+					return err
+				}
+			}
+			if _, pow := params.Engine.(*PoWEngine); pow && c.IsSet("workers") {
+				params.Engine = NewPoWEngine(c.Int("workers"))
+			}
+			if c.IsSet("pool-worker") {
+				return runPoolWorker("account", c.String("pool-worker"), c.Int("workers"))
+			}
+			if c.IsSet("listen") {
+				return serve("blockchain.db", "account", params, &nodeOptions{
+					listenAddr:   c.String("listen"),
+					peers:        c.StringSlice("peer"),
+					syncAddr:     c.String("sync"),
+					headersFirst: c.Bool("headers-first"),
+					mine:         c.Bool("mine"),
+					restartFee:   c.Uint64("restart-fee"),
+					apiAddr:      c.String("api"),
+					poolAddr:     c.String("pool"),
+					shareFactor:  c.Uint64("share-factor"),
+				})
+			}
+			start("blockchain.db", "account", params)
 			return nil
 		},
 	}
@@ -22,9 +121,8 @@ func main() {
 	}
 }
 
-func start(dbFile string, accountFile string) {
-	fmt.Println("Starting")
-
+// Opens the account stored in a file or generates and stores a new one
+func loadAccount(accountFile string) *Account {
 	var miner *Account
 
 	if accRaw, err := os.ReadFile(accountFile); err != nil {
@@ -39,8 +137,153 @@ func start(dbFile string, accountFile string) {
 		miner = AccountDeserialize(accRaw)
 		fmt.Printf("Account '%x' opened from file\n", miner.Id)
 	}
+	fmt.Printf("Public key '%x'\n", miner.PublicKey)
+	return miner
+}
+
+// How serve runs a network node
+type nodeOptions struct {
+	listenAddr string
+	peers      []string
+	// If set, the chain is downloaded from that node first
+	syncAddr string
+	// Additionally download block bodies from all peers while syncing
+	headersFirst bool
+	// The miner runs from the start if set and can be controlled through stdin either way
+	mine       bool
+	restartFee uint64
+	// If set, the HTTP API is served there
+	apiAddr string
+	// If set, a mining pool accepts workers there
+	poolAddr    string
+	shareFactor uint64
+}
+
+// Runs a network node until interrupted
+func serve(dbFile string, accountFile string, params *ChainParams, options *nodeOptions) error {
+	fmt.Printf("Starting %s node\n", params.Name)
 
-	bc, err := NewBlockchain(dbFile, miner)
+	miner := loadAccount(accountFile)
+	var bc *Blockchain
+	var err error
+	if options.syncAddr != "" {
+		bc, err = OpenBlockchain(dbFile, miner, params)
+	} else {
+		bc, err = NewBlockchain(dbFile, miner, params)
+	}
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	node := NewNode(bc, options.listenAddr)
+	if err := node.Start(); err != nil {
+		return err
+	}
+	defer node.Stop()
+
+	peers := options.peers
+	if options.syncAddr != "" {
+		onProgress := func(progress SyncProgress) {
+			fmt.Printf("Synced block %d/%d\n", progress.Height, progress.TargetHeight)
+		}
+		if options.headersFirst {
+			err = node.SyncHeadersFirst(append([]string{options.syncAddr}, peers...), onProgress)
+			// All peers are connected by the sync
+			peers = nil
+		} else {
+			err = node.Sync(options.syncAddr, onProgress)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println("Sync complete")
+	}
+
+	for _, addr := range peers {
+		if _, err := node.Connect(addr); err != nil {
+			fmt.Printf("Unable to connect to %s: %s\n", addr, err)
+		} else {
+			fmt.Printf("Connected to %s\n", addr)
+		}
+	}
+
+	daemon := NewMiner(node, options.restartFee)
+	if options.mine {
+		daemon.Start()
+	}
+	go controlMiner(os.Stdin, daemon)
+	if options.apiAddr != "" {
+		api := NewAPIServer(node, daemon, options.apiAddr)
+		if err := api.Start(); err != nil {
+			return err
+		}
+		defer api.Stop()
+	}
+	if options.poolAddr != "" {
+		pool := NewPool(node, options.poolAddr, options.shareFactor)
+		if err := pool.Start(); err != nil {
+			return err
+		}
+		defer pool.Stop()
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	fmt.Println("Shutting down")
+	daemon.Stop()
+	return nil
+}
+
+// Mines for the pool at poolAddr with `threads` goroutines until interrupted, paying the shares to the stored account
+func runPoolWorker(accountFile string, poolAddr string, threads int) error {
+	account := loadAccount(accountFile)
+	worker := NewPoolWorker(poolAddr, account.Id, threads)
+	if err := worker.Start(); err != nil {
+		return err
+	}
+	fmt.Printf("Mining for the pool at %s\n", poolAddr)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	fmt.Println("Shutting down")
+	worker.Stop()
+	accepted, rejected := worker.Shares()
+	fmt.Printf("Shares accepted: %d, rejected: %d\n", accepted, rejected)
+	return nil
+}
+
+// Reads the commands 'mine start', 'mine stop' and 'mine status' line by line until the input ends
+func controlMiner(input io.Reader, daemon *Miner) {
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		var err error
+		switch strings.TrimSpace(scanner.Text()) {
+		case "mine start":
+			err = daemon.Start()
+		case "mine stop":
+			err = daemon.Stop()
+		case "mine status":
+			status := daemon.Status()
+			fmt.Printf("Running: %t, blocks mined: %d, hashrate: %.0f H/s\n", status.Running, status.BlocksMined, status.Hashrate)
+		case "":
+		default:
+			err = errors.New("Unknown command, use 'mine start', 'mine stop' or 'mine status'")
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func start(dbFile string, accountFile string, params *ChainParams) {
+	fmt.Println("Starting")
+
+	miner := loadAccount(accountFile)
+
+	bc, err := NewBlockchain(dbFile, miner, params)
 	if err != nil {
 		panic(err)
 	}
@@ -55,25 +298,29 @@ func start(dbFile string, accountFile string) {
 	fmt.Println("Bob has: " + fmt.Sprint(bc.GetUTxOsForUser(bob.Id).Balance()))
 	fmt.Println("The miner has: " + fmt.Sprint(bc.GetUTxOsForUser(miner.Id).Balance()))
 
-	if err = bc.Send(miner, alice.Id, 50); err != nil {
+	// Mining rewards have to mature before they can be spent
+	for i := uint64(0); i < params.CoinbaseMaturity; i++ {
+		if _, err = bc.MineNext(); err != nil {
+			panic(err)
+		}
+	}
+
+	if _, err = bc.Send(miner, alice.Id, 50, 1); err != nil {
+		panic(err)
+	}
+	if _, err = bc.MineNext(); err != nil {
 		panic(err)
 	}
-	bc.MineNext()
 
 	fmt.Println("Alice has: " + fmt.Sprint(bc.GetUTxOsForUser(alice.Id).Balance()))
 	fmt.Println("Bob has: " + fmt.Sprint(bc.GetUTxOsForUser(bob.Id).Balance()))
 	fmt.Println("The miner has: " + fmt.Sprint(bc.GetUTxOsForUser(miner.Id).Balance()))
 
-	if err = bc.Send(alice, bob.Id, 30); err != nil {
+	if _, err = bc.Send(alice, bob.Id, 30, 1); err != nil {
 		panic(err)
 	}
 
-	block, err := bc.MineNext()
-	if err != nil {
-		panic(err)
-	}
-	err = bc.VerifyBlock(block)
-	if err != nil {
+	if _, err = bc.MineNext(); err != nil {
 		panic(err)
 	}
 
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Holds transactions waiting to be mined, in the order they arrived.
+// Transactions are indexed by their hash, so every transaction is only held once.
+// Safe for concurrent use.
+type Mempool struct {
+	mu sync.Mutex
+	// *Tx in arrival order
+	order  *list.List
+	byHash map[SHA256Sum]*list.Element
+}
+
+func NewMempool() *Mempool {
+	return &Mempool{
+		order:  list.New(),
+		byHash: make(map[SHA256Sum]*list.Element),
+	}
+}
+
+// Adds a transaction after all others. Fails if the transaction is already in the mempool.
+func (mp *Mempool) Push(tx *Tx) error {
+	txHash := tx.Hash()
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if _, ok := mp.byHash[txHash]; ok {
+		return errors.New(fmt.Sprintf("Transaction '%x' is already in the mempool", txHash))
+	}
+	mp.byHash[txHash] = mp.order.PushBack(tx)
+	return nil
+}
+
+// Takes the oldest transaction out of the mempool
+func (mp *Mempool) Pop() (*Tx, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	front := mp.order.Front()
+	if front == nil {
+		return nil, errors.New("Mempool empty")
+	}
+	tx := front.Value.(*Tx)
+	mp.remove(tx.Hash(), front)
+	return tx, nil
+}
+
+func (mp *Mempool) Count() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.order.Len()
+}
+
+// Finds a transaction in the mempool by its hash
+// Returns nil if there is no such transaction
+func (mp *Mempool) Find(txHash SHA256Sum) *Tx {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if element, ok := mp.byHash[txHash]; ok {
+		return element.Value.(*Tx)
+	}
+	return nil
+}
+
+// Takes a transaction out of the mempool by its hash
+// Returns nil if there is no such transaction
+func (mp *Mempool) Remove(txHash SHA256Sum) *Tx {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	element, ok := mp.byHash[txHash]
+	if !ok {
+		return nil
+	}
+	mp.remove(txHash, element)
+	return element.Value.(*Tx)
+}
+
+// Gets all transactions in the order they arrived
+func (mp *Mempool) Transactions() []*Tx {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	txs := make([]*Tx, 0, mp.order.Len())
+	for element := mp.order.Front(); element != nil; element = element.Next() {
+		txs = append(txs, element.Value.(*Tx))
+	}
+	return txs
+}
+
+// Gets the paths of all outputs spent by transactions in the mempool
+func (mp *Mempool) SpentOutputs() map[TxOPath]bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	spent := make(map[TxOPath]bool)
+	for element := mp.order.Front(); element != nil; element = element.Next() {
+		for _, in := range element.Value.(*Tx).Inputs {
+			spent[*in.Output] = true
+		}
+	}
+	return spent
+}
+
+// Removes all transactions contained in a block from the mempool
+func (mp *Mempool) RemoveBlockTransactions(block *Block) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	for _, tx := range block.Transactions {
+		txHash := tx.Hash()
+		if element, ok := mp.byHash[txHash]; ok {
+			mp.remove(txHash, element)
+		}
+	}
+}
+
+// Called with the mempool locked
+func (mp *Mempool) remove(txHash SHA256Sum, element *list.Element) {
+	mp.order.Remove(element)
+	delete(mp.byHash, txHash)
+}
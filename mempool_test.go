@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// Creates distinct transactions
+func createMempoolTxs(count int) []*Tx {
+	txs := make([]*Tx, count)
+	for i := range txs {
+		txs[i] = createTx()
+	}
+	return txs
+}
+
+func TestMempool(t *testing.T) {
+	mp := NewMempool()
+	txs := createMempoolTxs(3)
+	for _, tx := range txs {
+		if err := mp.Push(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mp.Push(txs[1]); err == nil || mp.Count() != 3 {
+		t.Fatal("Accepted a duplicate transaction")
+	}
+	if mp.Find(txs[2].Hash()) != txs[2] {
+		t.Fatal("Transaction not found by its hash")
+	}
+
+	if mp.Remove(txs[1].Hash()) != txs[1] || mp.Find(txs[1].Hash()) != nil {
+		t.Fatal("Transaction not removed by its hash")
+	}
+	if mp.Remove(txs[1].Hash()) != nil {
+		t.Fatal("Removed a transaction twice")
+	}
+	// A removed transaction may be added again, after the others
+	if err := mp.Push(txs[1]); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []*Tx{txs[0], txs[2], txs[1]} {
+		if tx, err := mp.Pop(); err != nil || tx != expected {
+			t.Fatal("Transactions not popped in the order they were pushed")
+		}
+	}
+	if _, err := mp.Pop(); err == nil {
+		t.Fatal("Popped from an empty mempool")
+	}
+}
+
+func TestMempoolConcurrency(t *testing.T) {
+	mp := NewMempool()
+	txs := createMempoolTxs(100)
+	wg := sync.WaitGroup{}
+	// Every transaction is pushed twice at the same time, only one push may succeed
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 2; i++ {
+		for _, tx := range txs {
+			wg.Add(1)
+			go func(tx *Tx) {
+				defer wg.Done()
+				if mp.Push(tx) == nil {
+					mu.Lock()
+					accepted++
+					mu.Unlock()
+				}
+				mp.SpentOutputs()
+			}(tx)
+		}
+	}
+	wg.Wait()
+	if accepted != len(txs) || mp.Count() != len(txs) {
+		t.Fatalf("Expected %d transactions, accepted %d and holding %d", len(txs), accepted, mp.Count())
+	}
+	for _, tx := range txs {
+		wg.Add(1)
+		go func(tx *Tx) {
+			defer wg.Done()
+			mp.Remove(tx.Hash())
+		}(tx)
+	}
+	wg.Wait()
+	if mp.Count() != 0 || len(mp.Transactions()) != 0 {
+		t.Fatal("Transactions left after removing all of them")
+	}
+}
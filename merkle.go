@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// Leaves and inner nodes are hashed with different prefixes,
+// so an inner node can never be passed off as a transaction.
+const (
+	merkleLeafPrefix  byte = 0x00
+	merkleInnerPrefix byte = 0x01
+)
+
+// A sibling on the path from a transaction to the Merkle root
+type MerkleProofStep struct {
+	Hash SHA256Sum
+	// Whether the sibling is the left node of the pair
+	Left bool
+}
+
+// The siblings needed to recompute the Merkle root from a transaction hash, ordered from the leaves up
+type MerkleProof []MerkleProofStep
+
+func merkleLeaf(txHash SHA256Sum) SHA256Sum {
+	return sha256.Sum256(append([]byte{merkleLeafPrefix}, txHash[:]...))
+}
+
+func merkleInner(left SHA256Sum, right SHA256Sum) SHA256Sum {
+	data := make([]byte, 0, 1+2*sha256.Size)
+	data = append(data, merkleInnerPrefix)
+	data = append(data, left[:]...)
+	data = append(data, right[:]...)
+	return sha256.Sum256(data)
+}
+
+// Hashes pairs of nodes to get the next level of the tree.
+// An odd node at the end is carried up unchanged.
+func merkleLevel(nodes []SHA256Sum) []SHA256Sum {
+	next := make([]SHA256Sum, 0, (len(nodes)+1)/2)
+	for i := 0; i < len(nodes); i += 2 {
+		if i+1 < len(nodes) {
+			next = append(next, merkleInner(nodes[i], nodes[i+1]))
+		} else {
+			next = append(next, nodes[i])
+		}
+	}
+	return next
+}
+
+// Calculates the Merkle root over a list of transaction hashes
+func MerkleRoot(txHashes []SHA256Sum) SHA256Sum {
+	if len(txHashes) == 0 {
+		return emptyHash
+	}
+	nodes := make([]SHA256Sum, len(txHashes))
+	for i, txHash := range txHashes {
+		nodes[i] = merkleLeaf(txHash)
+	}
+	for len(nodes) > 1 {
+		nodes = merkleLevel(nodes)
+	}
+	return nodes[0]
+}
+
+func (block *Block) txHashes() []SHA256Sum {
+	hashes := make([]SHA256Sum, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		hashes[i] = tx.Hash()
+	}
+	return hashes
+}
+
+// Calculates the Merkle root over the transactions of the block
+func (block *Block) CalcMerkleRoot() SHA256Sum {
+	return MerkleRoot(block.txHashes())
+}
+
+// Creates a proof that a transaction is part of the block
+func (block *Block) MerkleProof(txHash SHA256Sum) (MerkleProof, error) {
+	hashes := block.txHashes()
+	idx := -1
+	for i, hash := range hashes {
+		if hash == txHash {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return nil, errors.New(fmt.Sprintf("Transaction '%x' is not part of the block", txHash))
+	}
+
+	nodes := make([]SHA256Sum, len(hashes))
+	for i, hash := range hashes {
+		nodes[i] = merkleLeaf(hash)
+	}
+	proof := make(MerkleProof, 0)
+	for len(nodes) > 1 {
+		if idx%2 == 1 {
+			proof = append(proof, MerkleProofStep{Hash: nodes[idx-1], Left: true})
+		} else if idx+1 < len(nodes) {
+			proof = append(proof, MerkleProofStep{Hash: nodes[idx+1], Left: false})
+		}
+		nodes = merkleLevel(nodes)
+		idx /= 2
+	}
+	return proof, nil
+}
+
+// Checks that a proof leads from a transaction hash to the Merkle root of a block header
+func VerifyMerkleProof(txHash SHA256Sum, proof MerkleProof, root SHA256Sum) bool {
+	node := merkleLeaf(txHash)
+	for _, step := range proof {
+		if step.Left {
+			node = merkleInner(step.Hash, node)
+		} else {
+			node = merkleInner(node, step.Hash)
+		}
+	}
+	return node == root
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+)
+
+func blockWithTransactions(count int) *Block {
+	block := NewBlock()
+	for i := 0; i < count; i++ {
+		tx := createTx()
+		tx.Outputs[0].Value = uint64(i)
+		block.AddTransaction(tx)
+	}
+	block.MerkleRoot = block.CalcMerkleRoot()
+	return block
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for count := 1; count <= 9; count++ {
+		block := blockWithTransactions(count)
+		for _, tx := range block.Transactions {
+			proof, err := block.MerkleProof(tx.Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyMerkleProof(tx.Hash(), proof, block.MerkleRoot) {
+				t.Fatalf("Proof for a block with %d transactions does not verify", count)
+			}
+		}
+	}
+}
+
+func TestInvalidMerkleProofs(t *testing.T) {
+	block := blockWithTransactions(5)
+	outsider := createTx()
+	if _, err := block.MerkleProof(outsider.Hash()); err == nil {
+		t.Fatal("Created a proof for a transaction which is not part of the block")
+	}
+
+	txHash := block.Transactions[2].Hash()
+	proof, _ := block.MerkleProof(txHash)
+	if VerifyMerkleProof(outsider.Hash(), proof, block.MerkleRoot) {
+		t.Fatal("Proof verified for a different transaction")
+	}
+	proof[0].Left = !proof[0].Left
+	if VerifyMerkleProof(txHash, proof, block.MerkleRoot) {
+		t.Fatal("Tampered proof verified")
+	}
+}
+
+func TestMerkleRootCommitsToOrder(t *testing.T) {
+	block := blockWithTransactions(4)
+	root := block.MerkleRoot
+	block.Transactions[0], block.Transactions[1] = block.Transactions[1], block.Transactions[0]
+	if block.CalcMerkleRoot() == root {
+		t.Fatal("Reordering transactions did not change the Merkle root")
+	}
+}
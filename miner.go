@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How long the miner waits for a new latest block before retrying after mining failed,
+// e.g. because another validator is in turn
+const minerRetryInterval = time.Second
+
+// Keeps mining blocks on top of the latest block of a node until it is stopped.
+// Mining restarts with a new block from the mempool when another block becomes the latest block
+// or a transaction paying at least RestartFee arrives.
+type Miner struct {
+	node       *Node
+	RestartFee uint64
+
+	mu          sync.Mutex
+	stop        context.CancelFunc
+	done        chan struct{}
+	cancelRound context.CancelFunc
+	blocksMined uint64
+}
+
+// The state of a miner
+type MinerStatus struct {
+	Running     bool
+	BlocksMined uint64
+	// Hashes per second of the current or last block, if the network uses proof of work
+	Hashrate float64
+}
+
+func NewMiner(node *Node, restartFee uint64) *Miner {
+	miner := &Miner{
+		node:       node,
+		RestartFee: restartFee,
+	}
+	node.chainMu.Lock()
+	node.onTransaction = miner.transactionAdded
+	node.chainMu.Unlock()
+	return miner
+}
+
+// Starts mining in the background
+func (m *Miner) Start() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stop != nil {
+		return errors.New("Miner is already running")
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	m.stop = stop
+	m.done = make(chan struct{})
+	go m.run(ctx, m.done)
+	fmt.Println("Miner started")
+	return nil
+}
+
+// Stops mining and waits until the block being mined is abandoned
+func (m *Miner) Stop() error {
+	m.mu.Lock()
+	if m.stop == nil {
+		m.mu.Unlock()
+		return errors.New("Miner is not running")
+	}
+	m.stop()
+	done := m.done
+	m.mu.Unlock()
+
+	<-done
+	m.mu.Lock()
+	m.stop = nil
+	m.mu.Unlock()
+	fmt.Println("Miner stopped")
+	return nil
+}
+
+func (m *Miner) Status() MinerStatus {
+	m.mu.Lock()
+	status := MinerStatus{
+		Running:     m.stop != nil,
+		BlocksMined: m.blocksMined,
+	}
+	m.mu.Unlock()
+	if _, ok := m.node.bc.params.Engine.(*PoWEngine); ok {
+		status.Hashrate = m.node.bc.Hashrate()
+	}
+	return status
+}
+
+func (m *Miner) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	for ctx.Err() == nil {
+		roundCtx, cancel := context.WithCancel(ctx)
+		m.mu.Lock()
+		m.cancelRound = cancel
+		m.mu.Unlock()
+
+		m.node.chainMu.Lock()
+		tipChanged := m.node.tipChanged
+		m.node.chainMu.Unlock()
+
+		block, err := m.node.MineNextContext(roundCtx)
+		m.mu.Lock()
+		m.cancelRound = nil
+		if err == nil {
+			m.blocksMined++
+		}
+		m.mu.Unlock()
+		cancel()
+
+		switch {
+		case err == nil:
+			fmt.Printf("Mined block '%x'\n", block.PoW.Hash)
+		case errors.Is(err, context.Canceled):
+			// Stopped, or restarting with a new block
+		default:
+			fmt.Printf("Mining failed: %s\n", err)
+			select {
+			case <-tipChanged:
+			case <-time.After(minerRetryInterval):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// Restarts mining, so a transaction paying at least RestartFee goes into the next block.
+// Called by the node with the chain locked.
+func (m *Miner) transactionAdded(fee uint64) {
+	if fee < m.RestartFee {
+		return
+	}
+	m.mu.Lock()
+	if m.cancelRound != nil {
+		m.cancelRound()
+	}
+	m.mu.Unlock()
+}
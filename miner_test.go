@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMiner(t *testing.T) {
+	nodes, _ := createTestNodes(t, 2)
+	connectLine(t, nodes)
+	miner := NewMiner(nodes[0], 10)
+	if err := miner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := miner.Start(); err == nil {
+		t.Fatal("Started the miner twice")
+	}
+
+	waitFor(t, "mined blocks", func() bool {
+		nodes[1].chainMu.Lock()
+		defer nodes[1].chainMu.Unlock()
+		return nodes[1].bc.Height() >= 4
+	})
+	if err := miner.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	status := miner.Status()
+	if status.Running || status.BlocksMined < 3 {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+	if err := miner.Stop(); err == nil {
+		t.Fatal("Stopped the miner twice")
+	}
+}
+
+func TestMinerRestartsForHighFees(t *testing.T) {
+	params := RegtestParams
+	engine := &stallingEngine{PoWEngine: NewPoWEngine(1), sealing: make(chan struct{}, 1)}
+	params.Engine = engine
+	chains, miners := createTestChainsWithParams(t, 1, &params)
+	// A second mining reward, so two transactions can be sent
+	if _, err := chains[0].MineNext(); err != nil {
+		t.Fatal(err)
+	}
+	node := NewNode(chains[0], "127.0.0.1:0")
+	engine.stalled = node.bc
+	miner := NewMiner(node, 5)
+	if err := miner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer miner.Stop()
+	<-engine.sealing
+
+	receiver, _ := NewAccount()
+	if _, err := node.Send(miners[0], receiver.Id, 10, 1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-engine.sealing:
+		t.Fatal("Restarted mining for a low fee")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := node.Send(miners[0], receiver.Id, 10, 5); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-engine.sealing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Did not restart mining for a high fee")
+	}
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	protocolVersion  uint32        = 1
+	handshakeTimeout time.Duration = 5 * time.Second
+	pingTimeout      time.Duration = 5 * time.Second
+)
+
+type MessageType uint8
+
+const (
+	MsgVersion MessageType = iota
+	MsgVerAck
+	MsgPing
+	MsgPong
+	MsgInv
+	MsgGetData
+	MsgBlock
+	MsgTx
+	MsgGetBlocks
+	// Uses the same payload as getblocks, but is answered with a headers message
+	MsgGetHeaders
+	MsgHeaders
+)
+
+// The envelope sent over the wire.
+// The payload is the gob encoded body belonging to the message type.
+type Message struct {
+	Type    MessageType
+	Payload []byte
+}
+
+// Sent by both sides as the first message on a new connection
+type VersionPayload struct {
+	Version uint32
+	// Name of the network the senders chain belongs to
+	Network string
+	// nullHash if the senders chain is empty
+	LatestBlock  SHA256Sum
+	LatestHeight uint64
+	// The address the sender accepts connections on
+	ListenAddr string
+}
+
+// Used by ping and pong messages. A pong echoes the nonce of the ping it answers.
+type PingPayload struct {
+	Nonce uint64
+}
+
+type InvType uint8
+
+const (
+	InvBlock InvType = iota
+	InvTx
+)
+
+// Identifies a block (by PoW hash) or a transaction (by transaction hash)
+type InvItem struct {
+	Type InvType
+	Hash SHA256Sum
+}
+
+// Used by inv messages to announce objects and by getdata messages to request them
+type InvPayload struct {
+	Items []InvItem
+}
+
+func encodePayload(payload interface{}) []byte {
+	buf := bytes.Buffer{}
+	encoder := gob.NewEncoder(&buf)
+	err := encoder.Encode(payload)
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// Unlike the *Deserialize functions this does not panic,
+// because payloads are received from untrusted peers.
+func decodePayload(raw []byte, payload interface{}) error {
+	buf := bytes.Buffer{}
+	buf.Write(raw)
+	decoder := gob.NewDecoder(&buf)
+	return decoder.Decode(payload)
+}
+
+// A connection to a remote node
+type Peer struct {
+	Addr    string
+	conn    net.Conn
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+	writeMu sync.Mutex
+	// Set once the version message of the remote has been received
+	version *VersionPayload
+	// Closed once the remote has acknowledged our version
+	handshake chan struct{}
+	pongs     chan uint64
+}
+
+func newPeer(addr string, conn net.Conn) *Peer {
+	return &Peer{
+		Addr:      addr,
+		conn:      conn,
+		encoder:   gob.NewEncoder(conn),
+		decoder:   gob.NewDecoder(conn),
+		handshake: make(chan struct{}),
+		pongs:     make(chan uint64, 1),
+	}
+}
+
+// Sends a message to the peer. Safe for concurrent use.
+func (p *Peer) Send(msgType MessageType, payload interface{}) error {
+	msg := Message{
+		Type: msgType,
+	}
+	if payload != nil {
+		msg.Payload = encodePayload(payload)
+	}
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return p.encoder.Encode(&msg)
+}
+
+// A network node wrapping a blockchain.
+// Exchanges blocks and transactions with its peers.
+type Node struct {
+	bc         *Blockchain
+	listenAddr string
+	listener   net.Listener
+
+	// Serializes all access to the blockchain, which is not safe for concurrent use
+	chainMu sync.Mutex
+	// Closed and replaced when the latest block changes, so mining on the old one can stop. Guarded by chainMu.
+	tipChanged chan struct{}
+	miningMu   sync.Mutex
+	// Called with the fee of every transaction added to the mempool. Guarded by chainMu.
+	onTransaction func(fee uint64)
+
+	peersMu sync.Mutex
+	peers   map[string]*Peer
+
+	syncMu      sync.Mutex
+	sync        *syncState
+	headersSync *headersSyncState
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewNode(bc *Blockchain, listenAddr string) *Node {
+	return &Node{
+		bc:         bc,
+		listenAddr: listenAddr,
+		peers:      make(map[string]*Peer),
+		tipChanged: make(chan struct{}),
+		quit:       make(chan struct{}),
+	}
+}
+
+// Starts accepting peer connections on the listen address
+func (n *Node) Start() error {
+	listener, err := net.Listen("tcp", n.listenAddr)
+	if err != nil {
+		return err
+	}
+	n.listener = listener
+	n.listenAddr = listener.Addr().String()
+	fmt.Printf("Node listening on %s\n", n.listenAddr)
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-n.quit:
+					return
+				default:
+					fmt.Printf("Failed to accept connection: %s\n", err)
+					continue
+				}
+			}
+			// Our version has to be sent before reading,
+			// so it always precedes the verack on the wire
+			peer := newPeer(conn.RemoteAddr().String(), conn)
+			if err := n.sendVersion(peer); err != nil {
+				conn.Close()
+				continue
+			}
+			n.addPeer(peer)
+		}
+	}()
+	return nil
+}
+
+// The address the node accepts connections on
+func (n *Node) Addr() string {
+	return n.listenAddr
+}
+
+// Connects to a remote node and waits for the version handshake to complete
+func (n *Node) Connect(addr string) (*Peer, error) {
+	conn, err := net.DialTimeout("tcp", addr, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	peer := newPeer(addr, conn)
+	if err := n.sendVersion(peer); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	n.addPeer(peer)
+	select {
+	case <-peer.handshake:
+		return peer, nil
+	case <-time.After(handshakeTimeout):
+		conn.Close()
+		return nil, errors.New(fmt.Sprintf("Handshake with %s timed out", addr))
+	}
+}
+
+// Closes all connections and stops accepting new ones
+func (n *Node) Stop() {
+	close(n.quit)
+	if n.listener != nil {
+		n.listener.Close()
+	}
+	n.peersMu.Lock()
+	for _, peer := range n.peers {
+		peer.conn.Close()
+	}
+	n.peersMu.Unlock()
+	n.wg.Wait()
+}
+
+// Returns all peers which completed the handshake
+func (n *Node) Peers() []*Peer {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+	peers := make([]*Peer, 0, len(n.peers))
+	for _, peer := range n.peers {
+		select {
+		case <-peer.handshake:
+			peers = append(peers, peer)
+		default:
+		}
+	}
+	return peers
+}
+
+// Sends a ping to the peer and returns the round trip time
+func (n *Node) Ping(peer *Peer) (time.Duration, error) {
+	nonce := rand.Uint64()
+	start := time.Now()
+	if err := peer.Send(MsgPing, &PingPayload{Nonce: nonce}); err != nil {
+		return 0, err
+	}
+	timeout := time.After(pingTimeout)
+	for {
+		select {
+		case pong := <-peer.pongs:
+			if pong == nonce {
+				return time.Since(start), nil
+			}
+		case <-timeout:
+			return 0, errors.New(fmt.Sprintf("Ping to %s timed out", peer.Addr))
+		}
+	}
+}
+
+// Mines the next block and announces it to all peers
+func (n *Node) MineNext() (*Block, error) {
+	return n.MineNextContext(context.Background())
+}
+
+// Mines a block like MineNextContext of the chain and announces it to all peers.
+// The chain stays unlocked while mining, so blocks from peers are still processed.
+// If one of them becomes the latest block, mining stops with context.Canceled.
+func (n *Node) MineNextContext(ctx context.Context) (*Block, error) {
+	// The hashrate of the chain describes a single seal, so only one block is mined at a time
+	n.miningMu.Lock()
+	defer n.miningMu.Unlock()
+
+	n.chainMu.Lock()
+	block, err := n.bc.prepareBlock(map[AccountId]uint64{n.bc.miningAccount.Id: 1})
+	tipChanged := n.tipChanged
+	n.chainMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-tipChanged:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err = n.bc.SealBlock(ctx, block)
+
+	if err != nil {
+		return nil, err
+	}
+	// The transactions of the block stayed in the mempool while sealing, so peers can still get them
+	// and conflicting transactions are rejected. Connecting the block removes them.
+	if err := n.updateChain(func() error { return n.bc.AddBlock(block) }); err != nil {
+		return nil, err
+	}
+	n.broadcastInv(nil, InvItem{Type: InvBlock, Hash: block.PoW.Hash})
+	return block, nil
+}
+
+// Creates a template for an external miner like GetBlockTemplate of the chain
+func (n *Node) GetBlockTemplate(payTo AccountId) (*BlockTemplate, error) {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+	return n.bc.GetBlockTemplate(payTo)
+}
+
+// Creates a template splitting the mining reward like GetSharedBlockTemplate of the chain
+func (n *Node) GetSharedBlockTemplate(shares map[AccountId]uint64) (*BlockTemplate, error) {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+	return n.bc.GetSharedBlockTemplate(shares)
+}
+
+// Proposes a validator set change like ProposeValidator of the chain. Fails if the network doesn't use proof of authority.
+func (n *Node) ProposeValidator(validator ed25519.PublicKey, add bool) error {
+	if _, poa := n.bc.params.Engine.(*PoAEngine); !poa {
+		return errors.New(fmt.Sprintf("Network %s doesn't use proof of authority", n.bc.params.Name))
+	}
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+	return n.bc.ProposeValidator(validator, add)
+}
+
+// Adds a block sealed by an external miner like SubmitBlock of the chain and announces it to all peers
+func (n *Node) SubmitBlock(block *Block) error {
+	if err := n.updateChain(func() error { return n.bc.SubmitBlock(block) }); err != nil {
+		return err
+	}
+	n.broadcastInv(nil, InvItem{Type: InvBlock, Hash: block.PoW.Hash})
+	return nil
+}
+
+// Runs `update` with chainMu held and wakes up miners if it changed the latest block.
+// The lock is released even if `update` panics, e.g. on a malformed block submitted over the API.
+func (n *Node) updateChain(update func() error) error {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+	// The argument is evaluated now, before the update
+	defer n.tipUpdated(n.bc.latestBlock)
+	return update()
+}
+
+// Informs a miner about a transaction added to the mempool. chainMu has to be held.
+func (n *Node) transactionAdded(fee uint64) {
+	if n.onTransaction != nil {
+		n.onTransaction(fee)
+	}
+}
+
+// Wakes up miners if the latest block changed from `previous`. chainMu has to be held.
+func (n *Node) tipUpdated(previous SHA256Sum) {
+	if n.bc.latestBlock != previous {
+		close(n.tipChanged)
+		n.tipChanged = make(chan struct{})
+	}
+}
+
+// Creates a transaction and announces it to all peers
+func (n *Node) Send(from *Account, to AccountId, value uint64, fee uint64) (*Tx, error) {
+	var tx *Tx
+	err := n.updateChain(func() error {
+		var err error
+		if tx, err = n.bc.Send(from, to, value, fee); err == nil {
+			n.transactionAdded(fee)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.broadcastInv(nil, InvItem{Type: InvTx, Hash: tx.Hash()})
+	return tx, nil
+}
+
+func (n *Node) addPeer(peer *Peer) {
+	n.peersMu.Lock()
+	n.peers[peer.Addr] = peer
+	n.peersMu.Unlock()
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.readLoop(peer)
+	}()
+}
+
+func (n *Node) removePeer(peer *Peer) {
+	n.peersMu.Lock()
+	if n.peers[peer.Addr] == peer {
+		delete(n.peers, peer.Addr)
+	}
+	n.peersMu.Unlock()
+	peer.conn.Close()
+}
+
+func (n *Node) sendVersion(peer *Peer) error {
+	n.chainMu.Lock()
+	latestBlock := n.bc.latestBlock
+	latestHeight := n.bc.Height()
+	n.chainMu.Unlock()
+	return peer.Send(MsgVersion, &VersionPayload{
+		Version:      protocolVersion,
+		Network:      n.bc.params.Name,
+		LatestBlock:  latestBlock,
+		LatestHeight: latestHeight,
+		ListenAddr:   n.listenAddr,
+	})
+}
+
+// Announces an object to all peers except the one it was received from
+func (n *Node) broadcastInv(source *Peer, item InvItem) {
+	for _, peer := range n.Peers() {
+		if peer == source {
+			continue
+		}
+		peer.Send(MsgInv, &InvPayload{Items: []InvItem{item}})
+	}
+}
+
+func (n *Node) readLoop(peer *Peer) {
+	defer n.removePeer(peer)
+	for {
+		var msg Message
+		if err := peer.decoder.Decode(&msg); err != nil {
+			return
+		}
+		if err := n.handleMessage(peer, &msg); err != nil {
+			fmt.Printf("Error handling message from %s: %s\n", peer.Addr, err)
+		}
+	}
+}
+
+func (n *Node) handleMessage(peer *Peer, msg *Message) error {
+	// Nothing but the handshake is accepted before the remote version is known
+	if peer.version == nil && msg.Type != MsgVersion {
+		return errors.New("Received message before version")
+	}
+
+	switch msg.Type {
+	case MsgVersion:
+		var version VersionPayload
+		if err := decodePayload(msg.Payload, &version); err != nil {
+			return err
+		}
+		if version.Version != protocolVersion {
+			peer.conn.Close()
+			return errors.New(fmt.Sprintf("Incompatible protocol version %d", version.Version))
+		}
+		if version.Network != n.bc.params.Name {
+			peer.conn.Close()
+			return errors.New(fmt.Sprintf("Peer belongs to network '%s'", version.Network))
+		}
+		peer.version = &version
+		return peer.Send(MsgVerAck, nil)
+	case MsgVerAck:
+		select {
+		case <-peer.handshake:
+		default:
+			close(peer.handshake)
+		}
+		return nil
+	case MsgPing:
+		var ping PingPayload
+		if err := decodePayload(msg.Payload, &ping); err != nil {
+			return err
+		}
+		return peer.Send(MsgPong, &ping)
+	case MsgPong:
+		var pong PingPayload
+		if err := decodePayload(msg.Payload, &pong); err != nil {
+			return err
+		}
+		select {
+		case peer.pongs <- pong.Nonce:
+		default:
+		}
+		return nil
+	case MsgInv:
+		var inv InvPayload
+		if err := decodePayload(msg.Payload, &inv); err != nil {
+			return err
+		}
+		return n.handleInv(peer, &inv)
+	case MsgGetData:
+		var getData InvPayload
+		if err := decodePayload(msg.Payload, &getData); err != nil {
+			return err
+		}
+		return n.handleGetData(peer, &getData)
+	case MsgBlock:
+		var block Block
+		if err := decodePayload(msg.Payload, &block); err != nil {
+			return err
+		}
+		return n.handleBlock(peer, &block)
+	case MsgTx:
+		var tx Tx
+		if err := decodePayload(msg.Payload, &tx); err != nil {
+			return err
+		}
+		return n.handleTx(peer, &tx)
+	case MsgGetBlocks:
+		var getBlocks GetBlocksPayload
+		if err := decodePayload(msg.Payload, &getBlocks); err != nil {
+			return err
+		}
+		return n.handleGetBlocks(peer, &getBlocks)
+	case MsgGetHeaders:
+		var getHeaders GetBlocksPayload
+		if err := decodePayload(msg.Payload, &getHeaders); err != nil {
+			return err
+		}
+		return n.handleGetHeaders(peer, &getHeaders)
+	case MsgHeaders:
+		var headers HeadersPayload
+		if err := decodePayload(msg.Payload, &headers); err != nil {
+			return err
+		}
+		n.headersReceived(peer, &headers)
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("Unknown message type %d", msg.Type))
+	}
+}
+
+// Requests all announced objects which are not yet known
+func (n *Node) handleInv(peer *Peer, inv *InvPayload) error {
+	n.syncBatchReceived(peer, inv)
+	unknown := make([]InvItem, 0, len(inv.Items))
+	n.chainMu.Lock()
+	for _, item := range inv.Items {
+		switch item.Type {
+		case InvBlock:
+			if !n.bc.HasBlock(item.Hash) {
+				unknown = append(unknown, item)
+			}
+		case InvTx:
+			if n.bc.mempool.Find(item.Hash) == nil {
+				unknown = append(unknown, item)
+			}
+		}
+	}
+	n.chainMu.Unlock()
+	if len(unknown) == 0 {
+		return nil
+	}
+	return peer.Send(MsgGetData, &InvPayload{Items: unknown})
+}
+
+// Sends all requested objects which are known
+func (n *Node) handleGetData(peer *Peer, getData *InvPayload) error {
+	for _, item := range getData.Items {
+		switch item.Type {
+		case InvBlock:
+			n.chainMu.Lock()
+			block, err := n.bc.GetBlock(item.Hash)
+			n.chainMu.Unlock()
+			if err != nil {
+				continue
+			}
+			if err := peer.Send(MsgBlock, block); err != nil {
+				return err
+			}
+		case InvTx:
+			n.chainMu.Lock()
+			tx := n.bc.mempool.Find(item.Hash)
+			n.chainMu.Unlock()
+			if tx == nil {
+				continue
+			}
+			if err := peer.Send(MsgTx, tx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Checks that a received transaction can be handled without nil dereferences
+func txWellFormed(tx *Tx) bool {
+	for _, in := range tx.Inputs {
+		if in.Output == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Verifies a received block, adds it to the chain and relays it.
+// If the parent is unknown, the missing blocks are requested from the peer.
+func (n *Node) handleBlock(peer *Peer, block *Block) error {
+	if block.PoW == nil || block.LastBlockHash == emptyHash {
+		return errors.New("Received malformed block")
+	}
+	for _, tx := range block.Transactions {
+		if tx == nil || !txWellFormed(tx) {
+			return errors.New("Received block with malformed transaction")
+		}
+	}
+	if n.headersSyncBodyReceived(block) {
+		// Connected in order by the headers first sync
+		return nil
+	}
+	var added []*Block
+	var heights []uint64
+	err := n.updateChain(func() error {
+		var err error
+		added, err = n.bc.ProcessBlock(block)
+		heights = make([]uint64, len(added))
+		for i, addedBlock := range added {
+			if entry, err := n.bc.GetIndex(addedBlock.PoW.Hash); err == nil {
+				heights[i] = entry.Height
+			}
+		}
+		return err
+	})
+	if err == ErrOrphanBlock {
+		// Ask the peer for the blocks between our chain and the orphan
+		n.chainMu.Lock()
+		locator := n.bc.Locator()
+		n.chainMu.Unlock()
+		return peer.Send(MsgGetBlocks, &GetBlocksPayload{Locator: locator})
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, addedBlock := range added {
+		n.syncBlockConnected(addedBlock, heights[i])
+		n.broadcastInv(peer, InvItem{Type: InvBlock, Hash: addedBlock.PoW.Hash})
+	}
+	return nil
+}
+
+// Verifies a received transaction, adds it to the mempool and relays it
+func (n *Node) handleTx(peer *Peer, tx *Tx) error {
+	if !txWellFormed(tx) {
+		return errors.New("Received malformed transaction")
+	}
+	txHash := tx.Hash()
+	known := false
+	err := n.updateChain(func() error {
+		if n.bc.mempool.Find(txHash) != nil {
+			known = true
+			return nil
+		}
+		// Transactions conflicting with the mempool are rejected as double spends
+		fee, err := n.bc.verifyTransaction(tx, n.bc.mempool.SpentOutputs(), n.bc.latestHeight+1)
+		if err != nil {
+			return err
+		}
+		n.bc.mempool.Push(tx)
+		n.transactionAdded(fee)
+		return nil
+	})
+	if err != nil || known {
+		return err
+	}
+
+	n.broadcastInv(peer, InvItem{Type: InvTx, Hash: txHash})
+	return nil
+}
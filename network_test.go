@@ -0,0 +1,255 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// Starts a node for each of a set of chains sharing the same genesis block
+func createTestNodes(t *testing.T, count int) ([]*Node, []*Account) {
+	chains, miners := createTestChains(t, count)
+	nodes := make([]*Node, count)
+	for i, bc := range chains {
+		nodes[i] = NewNode(bc, "127.0.0.1:0")
+		if err := nodes[i].Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.Stop()
+		}
+	})
+	return nodes, miners
+}
+
+// Connects the nodes in a line, so objects have to be relayed to reach the last node
+func connectLine(t *testing.T, nodes []*Node) {
+	for i := 1; i < len(nodes); i++ {
+		if _, err := nodes[i].Connect(nodes[i-1].Addr()); err != nil {
+			t.Fatal(err)
+		}
+		// The handshake also has to complete on the accepting side
+		prev := nodes[i-1]
+		expected := 1
+		if i > 1 {
+			expected = 2
+		}
+		waitFor(t, "handshake", func() bool {
+			return len(prev.Peers()) == expected
+		})
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSync(t *testing.T) {
+	nodes, miners := createTestNodes(t, 1)
+	source := nodes[0]
+	receiver, _ := NewAccount()
+	for i := 0; i < 3; i++ {
+		if _, err := source.Send(miners[0], receiver.Id, 10, 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := source.MineNext(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A fresh node without a genesis block
+	miner, _ := NewAccount()
+	bc, err := OpenBlockchain(filepath.Join(t.TempDir(), "fresh.db"), miner, nodes[0].bc.params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := NewNode(bc, "127.0.0.1:0")
+	if err := fresh.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	defer fresh.Stop()
+
+	var reported []uint64
+	err = fresh.Sync(source.Addr(), func(progress SyncProgress) {
+		reported = append(reported, progress.Height)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(reported, []uint64{0, 1, 2, 3, 4}) {
+		t.Fatalf("Unexpected progress %v", reported)
+	}
+	if bc.latestBlock != source.bc.latestBlock {
+		t.Fatal("Synced chain does not match the source chain")
+	}
+	if balance := bc.GetUTxOsForUser(receiver.Id).Balance(); balance != 30 {
+		t.Fatalf("Expected receiver balance 30, got %d", balance)
+	}
+}
+
+func TestSyncHeadersFirst(t *testing.T) {
+	nodes, miners := createTestNodes(t, 2)
+	connectLine(t, nodes)
+	receiver, _ := NewAccount()
+	var block *Block
+	for i := 0; i < 5; i++ {
+		if _, err := nodes[0].Send(miners[0], receiver.Id, 10, 1); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if block, err = nodes[0].MineNext(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "block propagation", func() bool {
+		nodes[1].chainMu.Lock()
+		defer nodes[1].chainMu.Unlock()
+		return nodes[1].bc.latestBlock == block.PoW.Hash
+	})
+
+	miner, _ := NewAccount()
+	bc, err := OpenBlockchain(filepath.Join(t.TempDir(), "fresh.db"), miner, nodes[0].bc.params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := NewNode(bc, "127.0.0.1:0")
+	if err := fresh.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	defer fresh.Stop()
+
+	var reported []uint64
+	err = fresh.SyncHeadersFirst([]string{nodes[0].Addr(), nodes[1].Addr()}, func(progress SyncProgress) {
+		reported = append(reported, progress.Height)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(reported, []uint64{0, 1, 2, 3, 4, 5, 6}) {
+		t.Fatalf("Unexpected progress %v", reported)
+	}
+	if bc.latestBlock != block.PoW.Hash || bc.latestHeader != block.PoW.Hash {
+		t.Fatal("Synced chain does not match the source chain")
+	}
+	if balance := bc.GetUTxOsForUser(receiver.Id).Balance(); balance != 50 {
+		t.Fatalf("Expected receiver balance 50, got %d", balance)
+	}
+}
+
+func TestSyncWhileSyncingHeadersFirst(t *testing.T) {
+	nodes, _ := createTestNodes(t, 2)
+	if _, err := nodes[1].MineNext(); err != nil {
+		t.Fatal(err)
+	}
+	// A headers first sync is running
+	nodes[0].syncMu.Lock()
+	nodes[0].headersSync = &headersSyncState{}
+	nodes[0].syncMu.Unlock()
+	if err := nodes[0].Sync(nodes[1].Addr(), nil); err == nil {
+		t.Fatal("Started a sync while a headers first sync is running")
+	}
+}
+
+func TestPing(t *testing.T) {
+	nodes, _ := createTestNodes(t, 2)
+	peer, err := nodes[1].Connect(nodes[0].Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[1].Ping(peer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockPropagation(t *testing.T) {
+	nodes, _ := createTestNodes(t, 3)
+	connectLine(t, nodes)
+
+	block, err := nodes[0].MineNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes[1:] {
+		node := node
+		waitFor(t, "block propagation", func() bool {
+			node.chainMu.Lock()
+			defer node.chainMu.Unlock()
+			return node.bc.latestBlock == block.PoW.Hash
+		})
+	}
+}
+
+func TestTransactionPropagation(t *testing.T) {
+	nodes, miners := createTestNodes(t, 3)
+	connectLine(t, nodes)
+
+	receiver, _ := NewAccount()
+	tx, err := nodes[0].Send(miners[0], receiver.Id, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes[1:] {
+		node := node
+		waitFor(t, "transaction propagation", func() bool {
+			node.chainMu.Lock()
+			defer node.chainMu.Unlock()
+			return node.bc.mempool.Find(tx.Hash()) != nil
+		})
+	}
+
+	// The last node mines the transaction and the block travels back
+	block, err := nodes[2].MineNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "block propagation", func() bool {
+		nodes[0].chainMu.Lock()
+		defer nodes[0].chainMu.Unlock()
+		return nodes[0].bc.latestBlock == block.PoW.Hash && nodes[0].bc.mempool.Count() == 0
+	})
+	nodes[0].chainMu.Lock()
+	balance := nodes[0].bc.GetUTxOsForUser(receiver.Id).Balance()
+	nodes[0].chainMu.Unlock()
+	if balance != 10 {
+		t.Fatalf("Expected receiver balance 10, got %d", balance)
+	}
+}
+
+func TestChainUnlockedAfterPanic(t *testing.T) {
+	nodes, _ := createTestNodes(t, 1)
+	node := nodes[0]
+	// Like net/http, recover from a panic while checking a block
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Update didn't panic")
+			}
+		}()
+		node.updateChain(func() error {
+			panic("Malformed block")
+		})
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		node.GetBlockTemplate(node.bc.miningAccount.Id)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Chain stayed locked after a panic")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	maxOrphans int = 100
+	// Upper bound for the summed serialized size of all orphans
+	maxOrphanBytes int           = 16 * 1024 * 1024
+	orphanExpiry   time.Duration = 20 * time.Minute
+)
+
+// Returned by ProcessBlock if the parent of the block is unknown and it was put into the orphan pool
+var ErrOrphanBlock = errors.New("Block is an orphan, its parent is unknown")
+
+type orphan struct {
+	block *Block
+	size  int
+	added time.Time
+}
+
+// Holds blocks which arrived before their parent
+type OrphanPool struct {
+	byHash map[SHA256Sum]*orphan
+	// Orphans keyed by LastBlockHash, so they can be found once the parent arrives
+	byParent map[SHA256Sum][]*orphan
+	size     int
+	maxCount int
+	maxBytes int
+	expiry   time.Duration
+}
+
+func NewOrphanPool(maxCount int, maxBytes int, expiry time.Duration) *OrphanPool {
+	return &OrphanPool{
+		byHash:   make(map[SHA256Sum]*orphan),
+		byParent: make(map[SHA256Sum][]*orphan),
+		maxCount: maxCount,
+		maxBytes: maxBytes,
+		expiry:   expiry,
+	}
+}
+
+// Adds a block to the pool.
+// Expired orphans are dropped and the oldest orphans are evicted if the pool is full.
+func (op *OrphanPool) Add(block *Block) {
+	if op.Has(block.PoW.Hash) {
+		return
+	}
+	o := &orphan{
+		block: block,
+		size:  len(block.Serialize()),
+		added: time.Now(),
+	}
+	if o.size > op.maxBytes {
+		return
+	}
+
+	op.Expire()
+	for len(op.byHash) > 0 && (len(op.byHash) >= op.maxCount || op.size+o.size > op.maxBytes) {
+		op.remove(op.oldest())
+	}
+
+	op.byHash[block.PoW.Hash] = o
+	op.byParent[block.LastBlockHash] = append(op.byParent[block.LastBlockHash], o)
+	op.size += o.size
+}
+
+func (op *OrphanPool) Has(blockHash SHA256Sum) bool {
+	return op.byHash[blockHash] != nil
+}
+
+func (op *OrphanPool) Count() int {
+	return len(op.byHash)
+}
+
+// Removes and returns all orphans waiting for the given parent
+func (op *OrphanPool) TakeChildren(parent SHA256Sum) []*Block {
+	// Copied, because removing modifies the slice in the map
+	children := append([]*orphan(nil), op.byParent[parent]...)
+	blocks := make([]*Block, 0, len(children))
+	for _, o := range children {
+		blocks = append(blocks, o.block)
+		op.remove(o)
+	}
+	return blocks
+}
+
+// Drops all orphans older than the expiry duration
+func (op *OrphanPool) Expire() {
+	now := time.Now()
+	for _, o := range op.byHash {
+		if now.Sub(o.added) > op.expiry {
+			op.remove(o)
+		}
+	}
+}
+
+func (op *OrphanPool) oldest() *orphan {
+	var oldest *orphan
+	for _, o := range op.byHash {
+		if oldest == nil || o.added.Before(oldest.added) {
+			oldest = o
+		}
+	}
+	return oldest
+}
+
+func (op *OrphanPool) remove(o *orphan) {
+	delete(op.byHash, o.block.PoW.Hash)
+	siblings := op.byParent[o.block.LastBlockHash]
+	for i, sibling := range siblings {
+		if sibling == o {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(op.byParent, o.block.LastBlockHash)
+	} else {
+		op.byParent[o.block.LastBlockHash] = siblings
+	}
+	op.size -= o.size
+}
+
+// Verifies a block and adds it to the chain.
+// The transactions are verified once the block is connected to the main chain.
+// If its parent is unknown, the block is put into the orphan pool and ErrOrphanBlock is returned.
+// Orphans waiting for a newly added block are connected as well.
+// Returns all blocks which were added to the chain.
+func (bc *Blockchain) ProcessBlock(block *Block) ([]*Block, error) {
+	if bc.HasBlock(block.PoW.Hash) {
+		return nil, nil
+	}
+	if block.LastBlockHash != nullHash && !bc.HasBlock(block.LastBlockHash) {
+		// Only keep orphans with a valid seal, so the pool can't be filled for free
+		if err := bc.params.Engine.VerifyOrphanSeal(bc, &block.BlockHeader); err != nil {
+			return nil, err
+		}
+		bc.orphans.Add(block)
+		return nil, ErrOrphanBlock
+	}
+
+	if err := bc.verifyBlockStructure(block); err != nil {
+		return nil, err
+	}
+	if err := bc.AddBlock(block); err != nil {
+		return nil, err
+	}
+	added := []*Block{block}
+
+	// Connect orphans which were waiting for one of the added blocks
+	for i := 0; i < len(added); i++ {
+		for _, child := range bc.orphans.TakeChildren(added[i].PoW.Hash) {
+			if err := bc.verifyBlockStructure(child); err != nil {
+				fmt.Printf("Dropping invalid orphan '%x': %s\n", child.PoW.Hash, err)
+				continue
+			}
+			if err := bc.AddBlock(child); err != nil {
+				fmt.Printf("Dropping orphan '%x': %s\n", child.PoW.Hash, err)
+				continue
+			}
+			added = append(added, child)
+		}
+	}
+	return added, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOrphansConnectWhenParentArrives(t *testing.T) {
+	chains, _ := createTestChains(t, 2)
+	a, b := chains[0], chains[1]
+
+	blocks := make([]*Block, 3)
+	for i := range blocks {
+		var err error
+		if blocks[i], err = b.MineNext(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Deliver the blocks in reverse order
+	for _, block := range []*Block{blocks[2], blocks[1]} {
+		if _, err := a.ProcessBlock(block); err != ErrOrphanBlock {
+			t.Fatalf("Expected orphan error, got %v", err)
+		}
+	}
+	if a.orphans.Count() != 2 {
+		t.Fatalf("Expected 2 orphans, got %d", a.orphans.Count())
+	}
+
+	added, err := a.ProcessBlock(blocks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 3 {
+		t.Fatalf("Expected 3 added blocks, got %d", len(added))
+	}
+	if a.latestBlock != blocks[2].PoW.Hash {
+		t.Fatal("Orphans were not connected")
+	}
+	if a.orphans.Count() != 0 {
+		t.Fatalf("Expected empty orphan pool, got %d orphans", a.orphans.Count())
+	}
+}
+
+func TestOrphanPoolLimits(t *testing.T) {
+	chains, _ := createTestChains(t, 1)
+	blocks := make([]*Block, 3)
+	for i := range blocks {
+		var err error
+		if blocks[i], err = chains[0].MineNext(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pool := NewOrphanPool(2, maxOrphanBytes, time.Hour)
+	for _, block := range blocks {
+		pool.Add(block)
+	}
+	if pool.Count() != 2 || pool.Has(blocks[0].PoW.Hash) {
+		t.Fatal("Oldest orphan was not evicted")
+	}
+
+	// Room for either block, but not both
+	maxBytes := len(blocks[0].Serialize())
+	if size := len(blocks[1].Serialize()); size > maxBytes {
+		maxBytes = size
+	}
+	pool = NewOrphanPool(maxOrphans, maxBytes, time.Hour)
+	pool.Add(blocks[0])
+	pool.Add(blocks[1])
+	if pool.Count() != 1 || !pool.Has(blocks[1].PoW.Hash) {
+		t.Fatal("Orphans were not evicted when exceeding the size limit")
+	}
+
+	pool = NewOrphanPool(maxOrphans, maxOrphanBytes, time.Nanosecond)
+	pool.Add(blocks[0])
+	time.Sleep(time.Millisecond)
+	pool.Expire()
+	if pool.Count() != 0 {
+		t.Fatal("Orphan did not expire")
+	}
+}
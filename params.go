@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The rules of a network. Nodes only agree on a chain if they use the same parameters.
+type ChainParams struct {
+	Name string
+	// Prepended to all database bucket names, so chains of different networks are never mixed up
+	BucketPrefix string
+	// Seals blocks and decides which chain is the main chain
+	Engine ConsensusEngine
+
+	// The easiest allowed target, which is also used for the genesis block.
+	// A valid PoW hash has to be smaller than the target.
+	MaxTarget SHA256Sum
+	// The target is adjusted every RetargetInterval blocks
+	RetargetInterval uint64
+	// The block time the retargeting aims for
+	TargetBlockTime time.Duration
+	// The target changes by at most this factor per retarget
+	MaxRetargetFactor int64
+	// Keeps every block at MaxTarget
+	NoRetargeting bool
+
+	// The mining reward of the genesis block
+	InitialReward uint64
+	// The mining reward is halved every HalvingInterval blocks
+	HalvingInterval uint64
+	// Mining rewards can only be spent by blocks at least this many blocks later
+	CoinbaseMaturity uint64
+
+	// Limits for a block, including the mining reward transaction
+	MaxBlockSize         int
+	MaxBlockTransactions int
+
+	// The genesis block is the same for every node of a network.
+	// Its mining reward is paid to the all zero account, which nobody can spend from.
+	GenesisTimestamp int64
+	GenesisTag       string
+	GenesisNonce     uint64
+	GenesisHash      SHA256Sum
+}
+
+// The main network
+var MainnetParams = ChainParams{
+	Name:         "mainnet",
+	BucketPrefix: "",
+	Engine:       &PoWEngine{},
+	MaxTarget: SHA256Sum{
+		0x00, 0x00, 0b00000100, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	},
+	RetargetInterval:     10,
+	TargetBlockTime:      30 * time.Second,
+	MaxRetargetFactor:    4,
+	InitialReward:        100,
+	HalvingInterval:      1000,
+	CoinbaseMaturity:     10,
+	MaxBlockSize:         1024 * 1024,
+	MaxBlockTransactions: 4096,
+	GenesisTimestamp:     1767225600,
+	GenesisTag:           "goblockchain mainnet genesis",
+	GenesisNonce:         11244794,
+	GenesisHash: SHA256Sum{
+		0x00, 0x00, 0x00, 0x62, 0x0f, 0x9d, 0xf5, 0xd1,
+		0x71, 0x9b, 0xcc, 0x76, 0x54, 0x11, 0x52, 0xaf,
+		0x99, 0xb9, 0x01, 0xec, 0x26, 0x18, 0x6a, 0x01,
+		0xee, 0xcd, 0xec, 0x3d, 0x39, 0x7e, 0x10, 0xc6,
+	},
+}
+
+// A public test network with the rules of the main network, but an easier PoW
+var TestnetParams = ChainParams{
+	Name:         "testnet",
+	BucketPrefix: "testnet-",
+	Engine:       &PoWEngine{},
+	MaxTarget: SHA256Sum{
+		0x00, 0x00, 0b01000000, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	},
+	RetargetInterval:     10,
+	TargetBlockTime:      30 * time.Second,
+	MaxRetargetFactor:    4,
+	InitialReward:        100,
+	HalvingInterval:      1000,
+	CoinbaseMaturity:     10,
+	MaxBlockSize:         1024 * 1024,
+	MaxBlockTransactions: 4096,
+	GenesisTimestamp:     1767225600,
+	GenesisTag:           "goblockchain testnet genesis",
+	GenesisNonce:         20849,
+	GenesisHash: SHA256Sum{
+		0x00, 0x00, 0x2e, 0x76, 0x88, 0xa0, 0x1d, 0x20,
+		0x02, 0x0c, 0x92, 0xec, 0x29, 0x32, 0xe5, 0xcf,
+		0xe5, 0xf6, 0x66, 0x07, 0xdd, 0x5d, 0xfc, 0xa0,
+		0x98, 0x62, 0x4b, 0x31, 0xb4, 0x73, 0xe0, 0xb5,
+	},
+}
+
+// A local network for testing. Blocks are mined instantly and mining rewards can be spent right away.
+var RegtestParams = ChainParams{
+	Name:                 "regtest",
+	BucketPrefix:         "regtest-",
+	Engine:               &PoWEngine{},
+	MaxTarget:            SHA256Sum{0x7F},
+	RetargetInterval:     10,
+	TargetBlockTime:      30 * time.Second,
+	MaxRetargetFactor:    4,
+	NoRetargeting:        true,
+	InitialReward:        100,
+	HalvingInterval:      150,
+	CoinbaseMaturity:     1,
+	MaxBlockSize:         1024 * 1024,
+	MaxBlockTransactions: 4096,
+	GenesisTimestamp:     1767225600,
+	GenesisTag:           "goblockchain regtest genesis",
+	GenesisNonce:         0,
+	GenesisHash: SHA256Sum{
+		0x6d, 0x6e, 0x6f, 0xab, 0x31, 0x7f, 0x2e, 0x1d,
+		0xf0, 0xb7, 0x13, 0x96, 0x8a, 0x46, 0xa5, 0xa2,
+		0xc8, 0x8b, 0x1d, 0xaf, 0xc8, 0x12, 0x6d, 0x51,
+		0x2e, 0xfa, 0xbd, 0x3a, 0xc7, 0x7c, 0xd6, 0xc9,
+	},
+}
+
+// Gets a copy of the parameters of a predefined network
+func NetworkParams(name string) (*ChainParams, error) {
+	for _, params := range []ChainParams{MainnetParams, TestnetParams, RegtestParams} {
+		if params.Name == name {
+			return &params, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown network '%s'", name))
+}
+
+// Creates the parameters of a proof of authority network with the given validators.
+// The economic rules are the ones of the main network. The genesis block commits to the validators,
+// so networks with different validators don't share it.
+func NewPoAParams(name string, validators []ed25519.PublicKey) *ChainParams {
+	params := MainnetParams
+	params.Name = name
+	params.BucketPrefix = name + "-"
+	params.Engine = NewPoAEngine(validators)
+
+	validatorsHash := sha256.Sum256(bytes.Join(toByteSlices(validators), []byte{}))
+	params.GenesisTag = fmt.Sprintf("goblockchain %s genesis %x", name, validatorsHash[:8])
+	params.GenesisNonce = 0
+	params.GenesisHash = authorityHash(&params.GenesisBlock().BlockHeader)
+	return &params
+}
+
+func toByteSlices(keys []ed25519.PublicKey) [][]byte {
+	slices := make([][]byte, len(keys))
+	for i, key := range keys {
+		slices[i] = key
+	}
+	return slices
+}
+
+func (params *ChainParams) bucketName(name string) string {
+	return params.BucketPrefix + name
+}
+
+// Builds the genesis block of the network
+func (params *ChainParams) GenesisBlock() *Block {
+	block := NewBlock()
+	coinbase := NewCoinbaseTx(0, AccountId{}, params.InitialReward)
+	coinbase.Coinbase.Tag = []byte(params.GenesisTag)
+	block.AddTransaction(coinbase)
+	block.LastBlockHash = nullHash
+	block.MerkleRoot = block.CalcMerkleRoot()
+	block.Timestamp = params.GenesisTimestamp
+	block.Target = params.MaxTarget
+	block.PoW.Nonce = params.GenesisNonce
+	block.PoW.Hash = params.GenesisHash
+	return block
+}
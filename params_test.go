@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestNetworkParams(t *testing.T) {
+	params, err := NetworkParams("regtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.CoinbaseMaturity = 100
+	if RegtestParams.CoinbaseMaturity == 100 {
+		t.Fatal("Predefined parameters were modified through a lookup")
+	}
+	if _, err := NetworkParams("unknown"); err == nil {
+		t.Fatal("Found parameters for an unknown network")
+	}
+}
+
+func TestNetworksAreSeparated(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "chain.db")
+	miner, _ := NewAccount()
+	regtest := RegtestParams
+	bc, err := NewBlockchain(dbFile, miner, &regtest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.Close()
+
+	// The same database file doesn't contain a chain for another network
+	testnet := TestnetParams
+	bc, err = OpenBlockchain(dbFile, miner, &testnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	if !bc.IsEmpty() {
+		t.Fatal("Testnet chain contains the regtest chain")
+	}
+}
+
+// Seals the genesis block again after the parameters changed
+func resealGenesis(t *testing.T, params *ChainParams) {
+	genesis := params.GenesisBlock()
+	genesis.MerkleRoot = genesis.CalcMerkleRoot()
+	if err := params.Engine.Seal(context.Background(), nil, &genesis.BlockHeader); err != nil {
+		t.Fatal(err)
+	}
+	params.GenesisNonce, params.GenesisHash = genesis.PoW.Nonce, genesis.PoW.Hash
+}
+
+func TestGenesisBlock(t *testing.T) {
+	for _, params := range []ChainParams{MainnetParams, TestnetParams, RegtestParams} {
+		genesis := params.GenesisBlock()
+		if err := genesis.VerifyPoW(params.MaxTarget); err != nil {
+			t.Fatalf("Invalid %s genesis block: %v", params.Name, err)
+		}
+		if genesis.PoW.Hash != params.GenesisHash {
+			t.Fatalf("Hash of the %s genesis block doesn't match", params.Name)
+		}
+	}
+
+	dbFile := filepath.Join(t.TempDir(), "chain.db")
+	miner, _ := NewAccount()
+	params := RegtestParams
+	bc, err := NewBlockchain(dbFile, miner, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.Close()
+
+	// A database with another genesis block is refused
+	params.GenesisTag = "another genesis"
+	resealGenesis(t, &params)
+	if bc, err = OpenBlockchain(dbFile, miner, &params); err == nil {
+		bc.Close()
+		t.Fatal("Opened a chain with another genesis block")
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+)
+
+// The seal of a block on a proof of authority network
+type AuthoritySeal struct {
+	// The validator which signed the block
+	Signer AccountId
+	// An optional vote of the signer on changing the validator set
+	Vote *ValidatorVote
+	// Signature of the signer over the header, excluding the signature itself
+	Signature Signature
+}
+
+// A vote for adding a validator to or removing it from the validator set.
+// The change is made once more than half of the validators voted for it.
+type ValidatorVote struct {
+	Validator ed25519.PublicKey
+	Add       bool
+}
+
+// Get the binary representation of the seal for hashing purposes.
+// The signature is not part of it, so it can sign the header.
+func (seal *AuthoritySeal) Binary() []byte {
+	binarySeal := append([]byte{}, seal.Signer[:]...)
+	if seal.Vote != nil {
+		add := byte(0)
+		if seal.Vote.Add {
+			add = 1
+		}
+		binarySeal = append(binarySeal, add)
+		binarySeal = append(binarySeal, seal.Vote.Validator...)
+	}
+	return binarySeal
+}
+
+func (vote *ValidatorVote) Account() AccountId {
+	return sha256.Sum256(vote.Validator)
+}
+
+// The part of a header signed by a validator
+type signedHeader struct {
+	header *BlockHeader
+}
+
+func (signed signedHeader) Hash() SHA256Sum {
+	return sha256.Sum256(signed.header.Binary())
+}
+
+// The hash of a block on a proof of authority network, which covers the signature
+func authorityHash(header *BlockHeader) SHA256Sum {
+	binaryHeader := header.Binary()
+	if header.Authority != nil {
+		binaryHeader = append(binaryHeader, header.Authority.Signature...)
+	}
+	return sha256.Sum256(binaryHeader)
+}
+
+// Upper bound for the number of validator sets a PoAEngine caches by default
+const maxSnapshots int = 1024
+
+// Proof of authority. A fixed order of validators takes turns signing blocks,
+// so sealing a block is instant. Validators vote on changes to the validator set in the headers they sign.
+//
+// An engine caches the validator sets of the blocks of the chain it checks. The cache would let another chain
+// check blocks whose ancestors it doesn't know, so an engine must not be shared between chains.
+// NewPoAParams creates a new engine every time it is called.
+type PoAEngine struct {
+	// The validators of the genesis block
+	Validators []ed25519.PublicKey
+
+	// Validator sets by block hash, so the votes don't have to be tallied again for every block.
+	// The least recently used ones are evicted, so invalid and abandoned branches don't pile up.
+	snapshots map[SHA256Sum]*list.Element
+	// *cachedSnapshot, most recently used first
+	snapshotOrder *list.List
+	maxSnapshots  int
+	snapshotsMu   sync.Mutex
+}
+
+type cachedSnapshot struct {
+	blockHash SHA256Sum
+	snapshot  *validatorSnapshot
+}
+
+// The validator set after a block and the votes which didn't reach a majority yet
+type validatorSnapshot struct {
+	Validators map[AccountId]ed25519.PublicKey
+	// Votes by voter and the validator voted on
+	Votes map[AccountId]map[AccountId]*ValidatorVote
+}
+
+func NewPoAEngine(validators []ed25519.PublicKey) *PoAEngine {
+	return &PoAEngine{
+		Validators:    validators,
+		snapshots:     make(map[SHA256Sum]*list.Element),
+		snapshotOrder: list.New(),
+		maxSnapshots:  maxSnapshots,
+	}
+}
+
+// Signs the header with the mining account of the chain, which has to be the in-turn validator.
+// One of the pending proposals of the chain is added to the header as a vote.
+func (engine *PoAEngine) Seal(ctx context.Context, bc *Blockchain, header *BlockHeader) error {
+	snapshot, err := engine.snapshot(bc, header.LastBlockHash)
+	if err != nil {
+		return err
+	}
+	height, err := bc.childHeight(header.LastBlockHash)
+	if err != nil {
+		return err
+	}
+	signer := bc.miningAccount
+	if inTurn := snapshot.inTurn(height); inTurn != signer.Id {
+		return errors.New(fmt.Sprintf("Validator '%x' is in turn at height %d, not '%x'", inTurn, height, signer.Id))
+	}
+
+	header.Authority = &AuthoritySeal{
+		Signer: signer.Id,
+		Vote:   bc.nextVote(snapshot),
+	}
+	header.Authority.Signature = signer.Sign(signedHeader{header})
+	header.PoW.Nonce = 0
+	header.PoW.Hash = authorityHash(header)
+	return nil
+}
+
+// Verifies that the header is signed by the in-turn validator and that its vote is valid.
+// The genesis block has no signer.
+func (engine *PoAEngine) VerifySeal(bc *Blockchain, header *BlockHeader) error {
+	if authorityHash(header) != header.PoW.Hash {
+		return errors.New(fmt.Sprintf("Block invalid! The hash does not match the header."))
+	}
+	if header.LastBlockHash == nullHash {
+		if header.Authority != nil {
+			return errors.New(fmt.Sprintf("Block invalid! The genesis block is signed."))
+		}
+		return nil
+	}
+	if header.Authority == nil {
+		return errors.New(fmt.Sprintf("Block invalid! The block is not signed by a validator."))
+	}
+
+	snapshot, err := engine.snapshot(bc, header.LastBlockHash)
+	if err != nil {
+		return err
+	}
+	height, err := bc.childHeight(header.LastBlockHash)
+	if err != nil {
+		return err
+	}
+	signer := header.Authority.Signer
+	pubKey, authorized := snapshot.Validators[signer]
+	if !authorized {
+		return errors.New(fmt.Sprintf("Block invalid! Signer '%x' is not a validator.", signer))
+	}
+	if inTurn := snapshot.inTurn(height); inTurn != signer {
+		return errors.New(fmt.Sprintf("Block invalid! Signer '%x' is not in turn, '%x' is.", signer, inTurn))
+	}
+	hash := signedHeader{header}.Hash()
+	if !ed25519.Verify(pubKey, hash[:], header.Authority.Signature) {
+		return errors.New(fmt.Sprintf("Block invalid! Signature by '%x' is incorrect.", signer))
+	}
+	if vote := header.Authority.Vote; vote != nil {
+		if err := snapshot.checkVote(vote); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verifies that the hash matches the signed header. Whether the signer is the in-turn validator
+// depends on the validator set after the parent, so it is checked once the parent arrives.
+func (engine *PoAEngine) VerifyOrphanSeal(bc *Blockchain, header *BlockHeader) error {
+	if authorityHash(header) != header.PoW.Hash {
+		return errors.New(fmt.Sprintf("Block invalid! The hash does not match the header."))
+	}
+	if header.Authority == nil {
+		return errors.New(fmt.Sprintf("Block invalid! The block is not signed by a validator."))
+	}
+	return nil
+}
+
+// Blocks are not mined, so every block uses the easiest target
+func (engine *PoAEngine) NextTarget(bc *Blockchain, parentHash SHA256Sum) (SHA256Sum, error) {
+	return bc.params.MaxTarget, nil
+}
+
+// Every block weighs the same, so the longest chain is the main chain
+func (engine *PoAEngine) Weight(header *BlockHeader) *big.Int {
+	return big.NewInt(1)
+}
+
+// Gets the validator set after the given block, ordered by account id
+func (engine *PoAEngine) ValidatorsAt(bc *Blockchain, blockHash SHA256Sum) ([]AccountId, error) {
+	snapshot, err := engine.snapshot(bc, blockHash)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.sorted(), nil
+}
+
+func (engine *PoAEngine) snapshot(bc *Blockchain, blockHash SHA256Sum) (*validatorSnapshot, error) {
+	engine.snapshotsMu.Lock()
+	defer engine.snapshotsMu.Unlock()
+	if engine.snapshots == nil {
+		engine.snapshots = make(map[SHA256Sum]*list.Element)
+		engine.snapshotOrder = list.New()
+	}
+	if engine.maxSnapshots == 0 {
+		engine.maxSnapshots = maxSnapshots
+	}
+
+	// Walk back to the latest known validator set
+	var headers []*BlockHeader
+	var snapshot *validatorSnapshot
+	for {
+		if element, ok := engine.snapshots[blockHash]; ok {
+			engine.snapshotOrder.MoveToFront(element)
+			snapshot = element.Value.(*cachedSnapshot).snapshot
+			break
+		}
+		if blockHash == nullHash {
+			snapshot = newValidatorSnapshot(engine.Validators)
+			break
+		}
+		header, err := bc.GetHeader(blockHash)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+		blockHash = header.LastBlockHash
+	}
+
+	// Apply the votes of all blocks after it
+	for i := len(headers) - 1; i >= 0; i-- {
+		if headers[i].Authority != nil && headers[i].Authority.Vote != nil {
+			snapshot = snapshot.apply(headers[i].Authority.Signer, headers[i].Authority.Vote)
+		}
+		engine.cacheSnapshot(headers[i].PoW.Hash, snapshot)
+	}
+	return snapshot, nil
+}
+
+// Called with snapshotsMu held
+func (engine *PoAEngine) cacheSnapshot(blockHash SHA256Sum, snapshot *validatorSnapshot) {
+	engine.snapshots[blockHash] = engine.snapshotOrder.PushFront(&cachedSnapshot{blockHash, snapshot})
+	for engine.snapshotOrder.Len() > engine.maxSnapshots {
+		oldest := engine.snapshotOrder.Back()
+		engine.snapshotOrder.Remove(oldest)
+		delete(engine.snapshots, oldest.Value.(*cachedSnapshot).blockHash)
+	}
+}
+
+func newValidatorSnapshot(validators []ed25519.PublicKey) *validatorSnapshot {
+	snapshot := &validatorSnapshot{
+		Validators: make(map[AccountId]ed25519.PublicKey),
+		Votes:      make(map[AccountId]map[AccountId]*ValidatorVote),
+	}
+	for _, pubKey := range validators {
+		snapshot.Validators[sha256.Sum256(pubKey)] = pubKey
+	}
+	return snapshot
+}
+
+// The validators ordered by account id
+func (snapshot *validatorSnapshot) sorted() []AccountId {
+	ids := make([]AccountId, 0, len(snapshot.Validators))
+	for id := range snapshot.Validators {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+	return ids
+}
+
+// The validator which has to sign the block at the given height
+func (snapshot *validatorSnapshot) inTurn(height uint64) AccountId {
+	ids := snapshot.sorted()
+	return ids[height%uint64(len(ids))]
+}
+
+// Checks that a vote is for a valid key, would change the validator set and doesn't remove the last validator
+func (snapshot *validatorSnapshot) checkVote(vote *ValidatorVote) error {
+	if len(vote.Validator) != ed25519.PublicKeySize {
+		return errors.New(fmt.Sprintf("Block invalid! Vote for a key of %d bytes instead of %d.", len(vote.Validator), ed25519.PublicKeySize))
+	}
+	_, isValidator := snapshot.Validators[vote.Account()]
+	if vote.Add && isValidator {
+		return errors.New(fmt.Sprintf("Block invalid! Vote to add '%x', which is a validator already.", vote.Account()))
+	}
+	if !vote.Add && !isValidator {
+		return errors.New(fmt.Sprintf("Block invalid! Vote to remove '%x', which is not a validator.", vote.Account()))
+	}
+	if !vote.Add && len(snapshot.Validators) == 1 {
+		return errors.New(fmt.Sprintf("Block invalid! Vote to remove the last validator."))
+	}
+	return nil
+}
+
+// Creates the validator set after a validator cast a vote.
+// A voter's latest vote on a validator replaces its earlier ones.
+func (snapshot *validatorSnapshot) apply(voter AccountId, vote *ValidatorVote) *validatorSnapshot {
+	next := &validatorSnapshot{
+		Validators: make(map[AccountId]ed25519.PublicKey),
+		Votes:      make(map[AccountId]map[AccountId]*ValidatorVote),
+	}
+	for id, pubKey := range snapshot.Validators {
+		next.Validators[id] = pubKey
+	}
+	for id, votes := range snapshot.Votes {
+		next.Votes[id] = make(map[AccountId]*ValidatorVote)
+		for target, v := range votes {
+			next.Votes[id][target] = v
+		}
+	}
+	if next.Votes[voter] == nil {
+		next.Votes[voter] = make(map[AccountId]*ValidatorVote)
+	}
+	target := vote.Account()
+	next.Votes[voter][target] = vote
+
+	// Count the validators agreeing with the vote
+	count := 0
+	for id := range next.Validators {
+		if v, ok := next.Votes[id][target]; ok && v.Add == vote.Add {
+			count++
+		}
+	}
+	if count*2 <= len(next.Validators) {
+		return next
+	}
+
+	if vote.Add {
+		next.Validators[target] = vote.Validator
+	} else {
+		delete(next.Validators, target)
+		delete(next.Votes, target)
+	}
+	for _, votes := range next.Votes {
+		delete(votes, target)
+	}
+	return next
+}
+
+// Proposes adding a validator to or removing it from the validator set.
+// The proposal is voted for in the blocks the chain's mining account signs, until the change is made.
+func (bc *Blockchain) ProposeValidator(validator ed25519.PublicKey, add bool) error {
+	if len(validator) != ed25519.PublicKeySize {
+		return errors.New(fmt.Sprintf("Validator key has %d bytes instead of %d", len(validator), ed25519.PublicKeySize))
+	}
+	bc.proposalsMu.Lock()
+	defer bc.proposalsMu.Unlock()
+	bc.proposals[sha256.Sum256(validator)] = &ValidatorVote{
+		Validator: validator,
+		Add:       add,
+	}
+	return nil
+}
+
+// Picks a proposal to vote for, which would still change the validator set
+// and which the mining account didn't vote for yet. Proposals which are done are dropped.
+func (bc *Blockchain) nextVote(snapshot *validatorSnapshot) *ValidatorVote {
+	bc.proposalsMu.Lock()
+	defer bc.proposalsMu.Unlock()
+	ids := make([]AccountId, 0, len(bc.proposals))
+	for id, vote := range bc.proposals {
+		if snapshot.checkVote(vote) != nil {
+			delete(bc.proposals, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+	for _, id := range ids {
+		vote := bc.proposals[id]
+		if cast, ok := snapshot.Votes[bc.miningAccount.Id][id]; !ok || cast.Add != vote.Add {
+			return vote
+		}
+	}
+	return nil
+}
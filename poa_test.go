@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"path/filepath"
+	"testing"
+)
+
+// Creates a chain for each of `count` accounts of a new proof of authority network.
+// The first `validators` accounts are the validators of the genesis block. The returned engine is the one of the first chain.
+func createPoAChains(t *testing.T, count int, validators int) ([]*Blockchain, []*Account, *PoAEngine) {
+	accounts := make([]*Account, count)
+	keys := make([]ed25519.PublicKey, 0, validators)
+	for i := range accounts {
+		accounts[i], _ = NewAccount()
+		if i < validators {
+			keys = append(keys, accounts[i].PublicKey)
+		}
+	}
+	dir := t.TempDir()
+	chains := make([]*Blockchain, count)
+	for i := range chains {
+		// Every chain gets its own engine, like separate processes, so no validator sets are shared
+		params := NewPoAParams("poatest", keys)
+		var err error
+		if chains[i], err = NewBlockchain(filepath.Join(dir, "chain"+string(rune('a'+i))+".db"), accounts[i], params); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, bc := range chains {
+			bc.Close()
+		}
+	})
+	return chains, accounts, chains[0].params.Engine.(*PoAEngine)
+}
+
+// Lets the in-turn validator seal the next block and adds it to all other chains
+func sealInTurn(t *testing.T, chains []*Blockchain) *Block {
+	var block *Block
+	for _, bc := range chains {
+		var err error
+		if block, err = bc.MineNext(); err == nil {
+			break
+		}
+	}
+	if block == nil {
+		t.Fatal("No validator is in turn")
+	}
+	for _, bc := range chains {
+		if _, err := bc.ProcessBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return block
+}
+
+func TestPoATurns(t *testing.T) {
+	chains, _, engine := createPoAChains(t, 3, 3)
+	if chains[0].latestBlock != chains[1].latestBlock {
+		t.Fatal("Validators don't share the genesis block")
+	}
+	order, err := engine.ValidatorsAt(chains[0], chains[0].latestBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for height := uint64(1); height <= 6; height++ {
+		block := sealInTurn(t, chains)
+		if block.Authority.Signer != order[height%3] {
+			t.Fatalf("Block at height %d signed by '%x' instead of '%x'", height, block.Authority.Signer, order[height%3])
+		}
+	}
+
+	// Only the in-turn validator can seal the next block
+	var sealer, other *Blockchain
+	for _, bc := range chains {
+		if bc.miningAccount.Id == order[7%3] {
+			sealer = bc
+		} else {
+			other = bc
+		}
+	}
+	if _, err := other.MineNext(); err == nil {
+		t.Fatal("Sealed a block out of turn")
+	}
+	block, err := sealer.MineNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.VerifyBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	// A block signed out of turn or by someone else is rejected
+	outsider, _ := NewAccount()
+	for _, signer := range []*Account{other.miningAccount, outsider} {
+		block.Authority.Signer = signer.Id
+		block.Authority.Signature = signer.Sign(signedHeader{&block.BlockHeader})
+		block.PoW.Hash = authorityHash(&block.BlockHeader)
+		if err := other.VerifyBlock(block); err == nil {
+			t.Fatalf("Accepted block signed by '%x'", signer.Id)
+		}
+	}
+}
+
+func TestValidatorVoting(t *testing.T) {
+	chains, accounts, engine := createPoAChains(t, 4, 3)
+	validators := func() []AccountId {
+		current, err := engine.ValidatorsAt(chains[0], chains[0].latestBlock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return current
+	}
+	candidate := accounts[3]
+	for _, bc := range chains {
+		if err := bc.ProposeValidator(candidate.PublicKey, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two of three votes are a majority
+	for i := 0; i < 2; i++ {
+		if sealInTurn(t, chains).Authority.Vote == nil {
+			t.Fatal("Validator did not vote for the proposal")
+		}
+	}
+	if len(validators()) != 4 {
+		t.Fatalf("Expected 4 validators after the vote, got %d", len(validators()))
+	}
+	// The proposal is done, so nobody votes for it anymore. The new validator takes its turn.
+	signers := make(map[AccountId]bool)
+	for i := 0; i < 4; i++ {
+		block := sealInTurn(t, chains)
+		if block.Authority.Vote != nil {
+			t.Fatal("Voted for a change which was already made")
+		}
+		signers[block.Authority.Signer] = true
+	}
+	if !signers[candidate.Id] {
+		t.Fatal("New validator did not sign a block")
+	}
+
+	// Removing a validator needs three of four votes, which it may cast itself
+	removed := accounts[0]
+	for _, bc := range chains {
+		if err := bc.ProposeValidator(removed.PublicKey, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4 && len(validators()) == 4; i++ {
+		sealInTurn(t, chains)
+	}
+	for _, id := range validators() {
+		if id == removed.Id {
+			t.Fatal("Validator was not removed")
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if sealInTurn(t, chains).Authority.Signer == removed.Id {
+			t.Fatal("Removed validator signed a block")
+		}
+	}
+}
+
+func TestPoARelayAndCatchUp(t *testing.T) {
+	chains, _, _ := createPoAChains(t, 4, 3)
+	validators, observer := chains[:3], chains[3]
+	// The observer misses two blocks
+	for i := 0; i < 2; i++ {
+		sealInTurn(t, validators)
+	}
+
+	nodes := make([]*Node, len(chains))
+	for i, bc := range chains {
+		nodes[i] = NewNode(bc, "127.0.0.1:0")
+		if err := nodes[i].Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.Stop()
+		}
+	})
+	for _, node := range nodes[:3] {
+		if _, err := nodes[3].Connect(node.Addr()); err != nil {
+			t.Fatal(err)
+		}
+		// The handshake also has to complete on the accepting side
+		waitFor(t, "handshake", func() bool {
+			return len(node.Peers()) == 1
+		})
+	}
+
+	// The relayed block is an orphan for the observer, which then asks for the blocks it missed
+	var block *Block
+	for _, node := range nodes[:3] {
+		var err error
+		if block, err = node.MineNext(); err == nil {
+			break
+		}
+	}
+	if block == nil {
+		t.Fatal("No validator is in turn")
+	}
+	waitFor(t, "catch up", func() bool {
+		nodes[3].chainMu.Lock()
+		defer nodes[3].chainMu.Unlock()
+		return observer.latestBlock == block.PoW.Hash
+	})
+}
+
+func TestMalformedVote(t *testing.T) {
+	// A single validator is a majority on its own
+	chains, accounts, _ := createPoAChains(t, 2, 1)
+	if err := chains[0].ProposeValidator(make(ed25519.PublicKey, 5), true); err == nil {
+		t.Fatal("Proposed a malformed validator key")
+	}
+
+	block, err := chains[0].MineNext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block.Authority.Vote = &ValidatorVote{Validator: make(ed25519.PublicKey, 5), Add: true}
+	block.Authority.Signature = accounts[0].Sign(signedHeader{&block.BlockHeader})
+	block.PoW.Hash = authorityHash(&block.BlockHeader)
+	if err := chains[1].VerifyBlock(block); err == nil {
+		t.Fatal("Accepted a vote for a malformed validator key")
+	}
+}
+
+func TestSnapshotCacheLimit(t *testing.T) {
+	chains, accounts, engine := createPoAChains(t, 2, 1)
+	engine.maxSnapshots = 4
+	if err := chains[0].ProposeValidator(accounts[1].PublicKey, true); err != nil {
+		t.Fatal(err)
+	}
+	voted := sealInTurn(t, chains)
+	for i := 0; i < 10; i++ {
+		sealInTurn(t, chains)
+	}
+	if engine.snapshotOrder.Len() > 4 || len(engine.snapshots) > 4 {
+		t.Fatalf("Cached %d validator sets instead of at most 4", len(engine.snapshots))
+	}
+	// Evicted validator sets are tallied again from the headers
+	validators, err := engine.ValidatorsAt(chains[0], voted.PoW.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(validators) != 2 {
+		t.Fatalf("Expected 2 validators after the vote, got %d", len(validators))
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// How often the pool sends new jobs to its workers if the latest block doesn't change,
+// so they include new transactions and the latest shares in the mining reward
+const poolJobInterval = 10 * time.Second
+
+// The number of jobs of a worker which still accept shares for the same latest block
+const poolJobsKept = 4
+
+// The number of latest shares the mining reward is split by
+const poolShareWindow = 1024
+
+// A mining pool in the style of Stratum. Workers connect over TCP and exchange JSON messages, one per line:
+//
+//	-> {"id": 1, "method": "authorize", "account": "..."}  Authorizes a worker, which is paid to the account
+//	<- {"id": 1, "result": true}
+//	<- {"method": "job", "jobId": 7, "header": "...", "shareTarget": "..."}
+//	-> {"id": 2, "method": "submit", "jobId": 7, "nonce": 123}
+//	<- {"id": 2, "result": true}  or  {"id": 2, "error": "..."}
+//
+// The header of a job is hex encoded and misses only the nonce, like the binary header which is hashed for the PoW.
+// A share is a nonce for which the hash meets the share target, which is ShareFactor times easier than the block target.
+// Shares meeting the block target are added to the chain as blocks.
+// The mining reward of a block is split between the accounts in proportion to their part of the last poolShareWindow shares
+// at the time the job was handed out, so shares keep paying for a while after the pool found a block.
+type Pool struct {
+	node *Node
+	addr string
+	// Paid the mining reward of blocks found before any shares were submitted
+	account AccountId
+	// How many times easier the share target is than the block target
+	ShareFactor uint64
+
+	listener net.Listener
+
+	mu         sync.Mutex
+	workers    map[*poolWorkerConn]bool
+	jobs       map[uint64]*poolJob
+	lastJobId  uint64
+	extraNonce uint64
+	// The accounts of the latest shares, oldest first
+	shares      []AccountId
+	blocksFound uint64
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// A message of the pool protocol, either a request, a response or a job notification
+type poolMessage struct {
+	Id          uint64 `json:"id,omitempty"`
+	Method      string `json:"method,omitempty"`
+	Account     string `json:"account,omitempty"`
+	JobId       uint64 `json:"jobId,omitempty"`
+	Header      string `json:"header,omitempty"`
+	ShareTarget string `json:"shareTarget,omitempty"`
+	Nonce       uint64 `json:"nonce"`
+	Result      bool   `json:"result,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// A connected worker
+type poolWorkerConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	// Set once the worker is authorized. Guarded by the mutex of the pool.
+	account *AccountId
+	jobIds  []uint64
+}
+
+// A block template handed to a worker, with an extra nonce only used by this job
+type poolJob struct {
+	id          uint64
+	worker      *poolWorkerConn
+	template    *BlockTemplate
+	header      []byte
+	shareTarget SHA256Sum
+	submitted   map[uint64]bool
+}
+
+// The state of a pool
+type PoolStatus struct {
+	Workers     int
+	BlocksFound uint64
+	// The latest shares per account, which the mining reward is split by
+	Shares map[AccountId]uint64
+}
+
+func NewPool(node *Node, addr string, shareFactor uint64) *Pool {
+	if shareFactor == 0 {
+		shareFactor = 1
+	}
+	return &Pool{
+		node:        node,
+		addr:        addr,
+		account:     node.bc.miningAccount.Id,
+		ShareFactor: shareFactor,
+		workers:     make(map[*poolWorkerConn]bool),
+		jobs:        make(map[uint64]*poolJob),
+		quit:        make(chan struct{}),
+	}
+}
+
+// Starts accepting workers on the address
+func (pool *Pool) Start() error {
+	if _, ok := pool.node.bc.params.Engine.(*PoWEngine); !ok {
+		return errors.New("Mining pools need a proof of work network")
+	}
+	listener, err := net.Listen("tcp", pool.addr)
+	if err != nil {
+		return err
+	}
+	pool.listener = listener
+	pool.addr = listener.Addr().String()
+	fmt.Printf("Pool listening on %s\n", pool.addr)
+
+	pool.wg.Add(2)
+	go func() {
+		defer pool.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-pool.quit:
+					return
+				default:
+					fmt.Printf("Failed to accept worker: %s\n", err)
+					continue
+				}
+			}
+			worker := &poolWorkerConn{conn: conn}
+			pool.mu.Lock()
+			pool.workers[worker] = true
+			pool.mu.Unlock()
+			pool.wg.Add(1)
+			go pool.handleWorker(worker)
+		}
+	}()
+	go pool.refreshJobs()
+	return nil
+}
+
+// Disconnects all workers and stops accepting new ones
+func (pool *Pool) Stop() {
+	close(pool.quit)
+	if pool.listener != nil {
+		pool.listener.Close()
+	}
+	pool.mu.Lock()
+	for worker := range pool.workers {
+		worker.conn.Close()
+	}
+	pool.mu.Unlock()
+	pool.wg.Wait()
+}
+
+// The address the pool accepts workers on
+func (pool *Pool) Addr() string {
+	return pool.addr
+}
+
+func (pool *Pool) Status() PoolStatus {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	status := PoolStatus{
+		BlocksFound: pool.blocksFound,
+		Shares:      pool.shareCounts(),
+	}
+	for worker := range pool.workers {
+		if worker.account != nil {
+			status.Workers++
+		}
+	}
+	return status
+}
+
+func (pool *Pool) handleWorker(worker *poolWorkerConn) {
+	defer pool.wg.Done()
+	defer func() {
+		worker.conn.Close()
+		pool.mu.Lock()
+		delete(pool.workers, worker)
+		for _, id := range worker.jobIds {
+			delete(pool.jobs, id)
+		}
+		pool.mu.Unlock()
+	}()
+
+	decoder := json.NewDecoder(worker.conn)
+	for {
+		var request poolMessage
+		if err := decoder.Decode(&request); err != nil {
+			return
+		}
+		response := poolMessage{Id: request.Id, Result: true}
+		var err error
+		switch request.Method {
+		case "authorize":
+			err = pool.authorize(worker, request.Account)
+		case "submit":
+			err = pool.submit(worker, request.JobId, request.Nonce)
+		default:
+			err = errors.New(fmt.Sprintf("Unknown method '%s'", request.Method))
+		}
+		if err != nil {
+			response.Result = false
+			response.Error = err.Error()
+		}
+		if worker.send(&response) != nil {
+			return
+		}
+		if request.Method == "authorize" && err == nil {
+			if err := pool.sendJob(worker); err != nil {
+				fmt.Printf("Failed to send job: %s\n", err)
+			}
+		}
+	}
+}
+
+func (worker *poolWorkerConn) send(message *poolMessage) error {
+	worker.writeMu.Lock()
+	defer worker.writeMu.Unlock()
+	return json.NewEncoder(worker.conn).Encode(message)
+}
+
+func (pool *Pool) authorize(worker *poolWorkerConn, account string) error {
+	var id AccountId
+	decoded, err := hex.DecodeString(account)
+	if err != nil || len(decoded) != len(id) {
+		return errors.New(fmt.Sprintf("Invalid account '%s'", account))
+	}
+	copy(id[:], decoded)
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if worker.account != nil {
+		return errors.New("Worker is already authorized")
+	}
+	worker.account = &id
+	fmt.Printf("Worker %s authorized for '%x'\n", worker.conn.RemoteAddr(), id)
+	return nil
+}
+
+// Sends a new job for the latest block to a worker.
+// Jobs for other blocks become stale and only the last poolJobsKept jobs of the worker accept shares.
+func (pool *Pool) sendJob(worker *poolWorkerConn) error {
+	pool.mu.Lock()
+	payTo := pool.shareCounts()
+	if len(payTo) == 0 {
+		payTo[pool.account] = 1
+	}
+	pool.mu.Unlock()
+
+	template, err := pool.node.GetSharedBlockTemplate(payTo)
+	if err != nil {
+		return err
+	}
+
+	pool.mu.Lock()
+	pool.lastJobId++
+	pool.extraNonce++
+	// Every job gets its own extra nonce, so no two workers search the same headers
+	template.Coinbase.Coinbase.ExtraNonce = pool.extraNonce
+	job := &poolJob{
+		id:          pool.lastJobId,
+		worker:      worker,
+		template:    template,
+		header:      template.Block().Binary(),
+		shareTarget: shareTarget(template.Target, pool.ShareFactor),
+		submitted:   make(map[uint64]bool),
+	}
+	for id, other := range pool.jobs {
+		if other.template.LastBlockHash != template.LastBlockHash {
+			delete(pool.jobs, id)
+		}
+	}
+	pool.jobs[job.id] = job
+	worker.jobIds = append(worker.jobIds, job.id)
+	if len(worker.jobIds) > poolJobsKept {
+		delete(pool.jobs, worker.jobIds[0])
+		worker.jobIds = worker.jobIds[1:]
+	}
+	pool.mu.Unlock()
+
+	return worker.send(&poolMessage{
+		Method:      "job",
+		JobId:       job.id,
+		Header:      hex.EncodeToString(job.header),
+		ShareTarget: hex.EncodeToString(job.shareTarget[:]),
+	})
+}
+
+// Sends new jobs to all authorized workers whenever the latest block changes, or after poolJobInterval
+func (pool *Pool) refreshJobs() {
+	defer pool.wg.Done()
+	for {
+		pool.node.chainMu.Lock()
+		tipChanged := pool.node.tipChanged
+		pool.node.chainMu.Unlock()
+		select {
+		case <-tipChanged:
+		case <-time.After(poolJobInterval):
+		case <-pool.quit:
+			return
+		}
+
+		pool.mu.Lock()
+		workers := make([]*poolWorkerConn, 0, len(pool.workers))
+		for worker := range pool.workers {
+			if worker.account != nil {
+				workers = append(workers, worker)
+			}
+		}
+		pool.mu.Unlock()
+		for _, worker := range workers {
+			if err := pool.sendJob(worker); err != nil {
+				fmt.Printf("Failed to send job: %s\n", err)
+			}
+		}
+	}
+}
+
+// Credits a share of a worker and adds the block if the share also meets the block target
+func (pool *Pool) submit(worker *poolWorkerConn, jobId uint64, nonce uint64) error {
+	pool.mu.Lock()
+	job, err := pool.checkShare(worker, jobId, nonce)
+	if err != nil {
+		pool.mu.Unlock()
+		return err
+	}
+	job.submitted[nonce] = true
+	pool.shares = append(pool.shares, *worker.account)
+	if len(pool.shares) > poolShareWindow {
+		pool.shares = pool.shares[len(pool.shares)-poolShareWindow:]
+	}
+	pool.mu.Unlock()
+
+	hash := powHash(job.header, nonce)
+	if !meetsTarget(hash, job.template.Target) {
+		return nil
+	}
+	block := job.template.Block()
+	block.PoW = &PoW{Nonce: nonce, Hash: hash}
+	if err := pool.node.SubmitBlock(block); err != nil {
+		// The share still counts, the worker can't know the block became stale
+		fmt.Printf("Pool block '%x' rejected: %s\n", hash, err)
+		return nil
+	}
+	fmt.Printf("Pool found block '%x'\n", hash)
+	pool.mu.Lock()
+	pool.blocksFound++
+	// Shares for the old latest block are stale now, even before the workers get new jobs
+	for id, other := range pool.jobs {
+		if other.template.LastBlockHash == block.LastBlockHash {
+			delete(pool.jobs, id)
+		}
+	}
+	pool.mu.Unlock()
+	return nil
+}
+
+// Counts the latest shares per account. Called with the pool locked.
+func (pool *Pool) shareCounts() map[AccountId]uint64 {
+	counts := make(map[AccountId]uint64)
+	for _, id := range pool.shares {
+		counts[id]++
+	}
+	return counts
+}
+
+// Checks that a share is for a current job of the worker, new and meets the share target. Called with the pool locked.
+func (pool *Pool) checkShare(worker *poolWorkerConn, jobId uint64, nonce uint64) (*poolJob, error) {
+	if worker.account == nil {
+		return nil, errors.New("Worker is not authorized")
+	}
+	job := pool.jobs[jobId]
+	if job == nil || job.worker != worker {
+		return nil, errors.New(fmt.Sprintf("Job %d is stale or unknown", jobId))
+	}
+	if job.submitted[nonce] {
+		return nil, errors.New(fmt.Sprintf("Duplicate share for nonce %d", nonce))
+	}
+	if !meetsTarget(powHash(job.header, nonce), job.shareTarget) {
+		return nil, errors.New("Share does not meet the share target")
+	}
+	return job, nil
+}
+
+// The PoW hash of a binary header with the nonce
+func powHash(binaryHeader []byte, nonce uint64) SHA256Sum {
+	nonceRaw := make([]byte, 8)
+	binary.LittleEndian.PutUint64(nonceRaw, nonce)
+	return sha256.Sum256(append(binaryHeader[:len(binaryHeader):len(binaryHeader)], nonceRaw...))
+}
+
+// The block target multiplied by factor, at most the easiest possible target
+func shareTarget(target SHA256Sum, factor uint64) SHA256Sum {
+	value := new(big.Int).SetBytes(target[:])
+	value.Mul(value, new(big.Int).SetUint64(factor))
+	var easier SHA256Sum
+	if value.BitLen() > len(easier)*8 {
+		for i := range easier {
+			easier[i] = 0xFF
+		}
+		return easier
+	}
+	value.FillBytes(easier[:])
+	return easier
+}
+
+// A worker of a pool, which searches shares for the jobs of the pool
+type PoolWorker struct {
+	addr    string
+	account AccountId
+	engine  *PoWEngine
+
+	hashes    hashMeter
+	conn      net.Conn
+	writeMu   sync.Mutex
+	lastId    uint64
+	cancelJob context.CancelFunc
+
+	mu       sync.Mutex
+	accepted uint64
+	rejected uint64
+
+	wg sync.WaitGroup
+}
+
+// Creates a worker for the pool at addr paying shares to account. It searches with `threads` goroutines, or all CPUs if it is 0.
+func NewPoolWorker(addr string, account AccountId, threads int) *PoolWorker {
+	return &PoolWorker{
+		addr:    addr,
+		account: account,
+		engine:  NewPoWEngine(threads),
+	}
+}
+
+// Connects to the pool, authorizes and starts working on the jobs of the pool
+func (w *PoolWorker) Start() error {
+	conn, err := net.DialTimeout("tcp", w.addr, handshakeTimeout)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	w.wg.Add(1)
+	go w.run()
+	return w.send(&poolMessage{Method: "authorize", Account: hex.EncodeToString(w.account[:])})
+}
+
+// Disconnects from the pool and stops working
+func (w *PoolWorker) Stop() {
+	w.conn.Close()
+	w.wg.Wait()
+}
+
+// The number of shares accepted and rejected by the pool
+func (w *PoolWorker) Shares() (uint64, uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.accepted, w.rejected
+}
+
+func (w *PoolWorker) send(message *poolMessage) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	w.lastId++
+	message.Id = w.lastId
+	return json.NewEncoder(w.conn).Encode(message)
+}
+
+func (w *PoolWorker) run() {
+	defer w.wg.Done()
+	var jobs sync.WaitGroup
+	defer func() {
+		if w.cancelJob != nil {
+			w.cancelJob()
+		}
+		jobs.Wait()
+	}()
+
+	decoder := json.NewDecoder(w.conn)
+	for {
+		var message poolMessage
+		if err := decoder.Decode(&message); err != nil {
+			return
+		}
+		switch {
+		case message.Method == "job":
+			header, err := hex.DecodeString(message.Header)
+			var target SHA256Sum
+			rawTarget, targetErr := hex.DecodeString(message.ShareTarget)
+			if err != nil || targetErr != nil || len(rawTarget) != len(target) {
+				fmt.Printf("Invalid job %d from the pool\n", message.JobId)
+				continue
+			}
+			copy(target[:], rawTarget)
+			if w.cancelJob != nil {
+				w.cancelJob()
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			w.cancelJob = cancel
+			jobs.Add(1)
+			go func(jobId uint64) {
+				defer jobs.Done()
+				w.work(ctx, jobId, header, target)
+			}(message.JobId)
+		case message.Error != "":
+			w.mu.Lock()
+			w.rejected++
+			w.mu.Unlock()
+			fmt.Printf("Pool rejected request %d: %s\n", message.Id, message.Error)
+		case message.Result && message.Id > 1:
+			// The first response is for the authorization
+			w.mu.Lock()
+			w.accepted++
+			w.mu.Unlock()
+		}
+	}
+}
+
+// Searches shares for a job until it is cancelled. Thread i tries the nonces i, i+n, i+2n, ... for n threads.
+func (w *PoolWorker) work(ctx context.Context, jobId uint64, header []byte, target SHA256Sum) {
+	threads := w.engine.Workers
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func(first uint64) {
+			defer wg.Done()
+			for {
+				pow := w.engine.search(ctx, &w.hashes, header, target, first, uint64(threads))
+				if pow == nil {
+					return
+				}
+				if err := w.send(&poolMessage{Method: "submit", JobId: jobId, Nonce: pow.Nonce}); err != nil {
+					return
+				}
+				if pow.Nonce+uint64(threads) < pow.Nonce {
+					// Nonce space exhausted, wait for the next job
+					return
+				}
+				first = pow.Nonce + uint64(threads)
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+}
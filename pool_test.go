@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// Creates a node on a network where blocks are harder than shares and starts a pool for it
+func createTestPool(t *testing.T, shareFactor uint64) (*Pool, *Node) {
+	params := RegtestParams
+	params.MaxTarget = SHA256Sum{0x00, 0x04}
+	resealGenesis(t, &params)
+	chains, _ := createTestChainsWithParams(t, 1, &params)
+	node := NewNode(chains[0], "127.0.0.1:0")
+	pool := NewPool(node, "127.0.0.1:0", shareFactor)
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Stop)
+	return pool, node
+}
+
+func TestPool(t *testing.T) {
+	pool, node := createTestPool(t, 16)
+	startHeight := node.bc.Height()
+	accounts := make(map[AccountId]bool)
+	workers := make([]*PoolWorker, 2)
+	for i := range workers {
+		account, _ := NewAccount()
+		accounts[account.Id] = true
+		workers[i] = NewPoolWorker(pool.Addr(), account.Id, 1)
+		if err := workers[i].Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "shares of all workers", func() bool {
+		return len(pool.Status().Shares) == len(workers)
+	})
+	// Jobs handed out after the next block pay all workers
+	found := pool.Status().BlocksFound
+	waitFor(t, "pool blocks", func() bool {
+		return pool.Status().BlocksFound >= found+2
+	})
+	for _, worker := range workers {
+		worker.Stop()
+		// Shares for the previous block may still be rejected as stale
+		if accepted, _ := worker.Shares(); accepted == 0 {
+			t.Fatal("Worker had no shares accepted")
+		}
+	}
+
+	node.chainMu.Lock()
+	defer node.chainMu.Unlock()
+	paidWorkers := make(map[AccountId]bool)
+	for hash := node.bc.latestBlock; ; {
+		block, err := node.bc.GetBlock(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		height := block.Transactions[0].Coinbase.Height
+		if height <= startHeight {
+			break
+		}
+		var paid uint64
+		for _, out := range block.Transactions[0].Outputs {
+			if accounts[out.To] {
+				paidWorkers[out.To] = true
+			} else if out.To != pool.account {
+				t.Fatalf("Block at height %d pays '%x', which is neither a worker nor the pool", height, out.To)
+			}
+			paid += out.Value
+		}
+		if paid != node.bc.params.BlockReward(height) {
+			t.Fatalf("Block at height %d pays %d instead of the block reward", height, paid)
+		}
+		hash = block.LastBlockHash
+	}
+	if len(paidWorkers) != len(workers) {
+		t.Fatalf("Only %d of %d workers were paid", len(paidWorkers), len(workers))
+	}
+}
+
+func TestPoolRejectsShares(t *testing.T) {
+	pool, _ := createTestPool(t, 16)
+	conn, err := net.Dial("tcp", pool.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+	request := func(message poolMessage) poolMessage {
+		if err := encoder.Encode(&message); err != nil {
+			t.Fatal(err)
+		}
+		// A share meeting the block target sends a new job before the response
+		for {
+			var response poolMessage
+			if err := decoder.Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Method != "job" {
+				return response
+			}
+		}
+	}
+
+	if response := request(poolMessage{Id: 1, Method: "submit", JobId: 1}); response.Error == "" {
+		t.Fatal("Accepted a share of an unauthorized worker")
+	}
+	account, _ := NewAccount()
+	if response := request(poolMessage{Id: 2, Method: "authorize", Account: hex.EncodeToString(account.Id[:])}); !response.Result {
+		t.Fatalf("Authorization failed: %s", response.Error)
+	}
+	var job poolMessage
+	if err := decoder.Decode(&job); err != nil || job.Method != "job" {
+		t.Fatal("Expected a job after the authorization")
+	}
+	header, _ := hex.DecodeString(job.Header)
+	var target SHA256Sum
+	rawTarget, _ := hex.DecodeString(job.ShareTarget)
+	copy(target[:], rawTarget)
+	if target != shareTarget(pool.node.bc.params.MaxTarget, 16) {
+		t.Fatalf("Unexpected share target %x", target)
+	}
+
+	share := NewPoWEngine(1).search(context.Background(), &hashMeter{}, header, target, 0, 1)
+	if response := request(poolMessage{Id: 3, Method: "submit", JobId: job.JobId, Nonce: share.Nonce}); !response.Result {
+		t.Fatalf("Share rejected: %s", response.Error)
+	}
+	if response := request(poolMessage{Id: 4, Method: "submit", JobId: job.JobId, Nonce: share.Nonce}); response.Error == "" {
+		t.Fatal("Accepted a duplicate share")
+	}
+	if response := request(poolMessage{Id: 5, Method: "submit", JobId: job.JobId + 1, Nonce: share.Nonce}); response.Error == "" {
+		t.Fatal("Accepted a share for an unknown job")
+	}
+	invalid := share.Nonce + 1
+	for meetsTarget(powHash(header, invalid), target) {
+		invalid++
+	}
+	if response := request(poolMessage{Id: 6, Method: "submit", JobId: job.JobId, Nonce: invalid}); response.Error == "" {
+		t.Fatal("Accepted a share which doesn't meet the share target")
+	}
+	if shares := pool.Status().Shares[account.Id]; shares != 1 {
+		t.Fatalf("Expected 1 share, got %d", shares)
+	}
+}
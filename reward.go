@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"math/bits"
+	"sort"
+)
+
+// The number of new coins a block at the given height may create.
+// The reward is halved every HalvingInterval blocks until it reaches zero.
+func (params *ChainParams) BlockReward(height uint64) uint64 {
+	halvings := height / params.HalvingInterval
+	if halvings >= 64 {
+		return 0
+	}
+	return params.InitialReward >> halvings
+}
+
+// The number of coins created by the mining rewards of all blocks up to and including the given height.
+// Miners may claim less than the full reward, so this is an upper bound for the coins in circulation.
+func (params *ChainParams) TotalSupply(height uint64) uint64 {
+	var supply uint64
+	for start := uint64(0); start <= height; start += params.HalvingInterval {
+		reward := params.BlockReward(start)
+		if reward == 0 {
+			break
+		}
+		blocks := params.HalvingInterval
+		if height-start < params.HalvingInterval {
+			// The last, incomplete interval
+			blocks = height - start + 1
+		}
+		supply += blocks * reward
+	}
+	return supply
+}
+
+// The number of coins which will ever be created
+func (params *ChainParams) MaxSupply() uint64 {
+	return params.TotalSupply(64*params.HalvingInterval - 1)
+}
+
+// Splits a mining reward between accounts in proportion to their shares, in the order of the account ids.
+// The remainder of the division goes to the first account. Accounts whose part rounds down to zero get no output.
+func splitReward(value uint64, shares map[AccountId]uint64) []TxO {
+	ids := make([]AccountId, 0, len(shares))
+	var total uint64
+	for id, count := range shares {
+		if count == 0 {
+			continue
+		}
+		ids = append(ids, id)
+		total += count
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+
+	outputs := make([]TxO, 0, len(ids))
+	var paid uint64
+	for _, id := range ids {
+		// value * shares / total without overflowing
+		hi, lo := bits.Mul64(value, shares[id])
+		part, _ := bits.Div64(hi, lo, total)
+		paid += part
+		outputs = append(outputs, TxO{To: id, Value: part})
+	}
+	if len(outputs) > 0 {
+		outputs[0].Value += value - paid
+	}
+
+	nonZero := outputs[:0]
+	for _, out := range outputs {
+		if out.Value > 0 {
+			nonZero = append(nonZero, out)
+		}
+	}
+	if len(nonZero) == 0 && len(outputs) > 0 {
+		// A block without reward still needs an output
+		nonZero = outputs[:1]
+	}
+	return nonZero
+}
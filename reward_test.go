@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBlockReward(t *testing.T) {
+	params := MainnetParams
+	initialReward, halvingInterval := params.InitialReward, params.HalvingInterval
+	rewards := map[uint64]uint64{
+		0:                    initialReward,
+		halvingInterval - 1:  initialReward,
+		halvingInterval:      initialReward / 2,
+		3 * halvingInterval:  initialReward / 8,
+		64 * halvingInterval: 0,
+		math.MaxUint64:       0,
+	}
+	for height, expected := range rewards {
+		if reward := params.BlockReward(height); reward != expected {
+			t.Fatalf("Expected reward %d at height %d, got %d", expected, height, reward)
+		}
+	}
+}
+
+func TestTotalSupply(t *testing.T) {
+	params := MainnetParams
+	initialReward, halvingInterval := params.InitialReward, params.HalvingInterval
+	if supply := params.TotalSupply(0); supply != initialReward {
+		t.Fatalf("Expected supply %d at genesis, got %d", initialReward, supply)
+	}
+	expected := halvingInterval*initialReward + initialReward/2
+	if supply := params.TotalSupply(halvingInterval); supply != expected {
+		t.Fatalf("Expected supply %d after the first halving, got %d", expected, supply)
+	}
+
+	// Summing up every block has to give the same result
+	var sum uint64
+	for height := uint64(0); params.BlockReward(height) > 0; height++ {
+		sum += params.BlockReward(height)
+	}
+	if sum != params.MaxSupply() {
+		t.Fatalf("Expected max supply %d, got %d", sum, params.MaxSupply())
+	}
+	if params.TotalSupply(math.MaxUint64) != params.MaxSupply() {
+		t.Fatal("Supply keeps growing after the reward reached zero")
+	}
+}
+
+func TestCoinbaseMaturity(t *testing.T) {
+	params := RegtestParams
+	params.CoinbaseMaturity = 3
+	chains, miners := createTestChainsWithParams(t, 1, &params)
+	bc, miner := chains[0], miners[0]
+	receiver, _ := NewAccount()
+
+	reward := (*bc.GetUTxOsForUser(miner.Id))[0]
+	tx := spendOutput(miner, reward, receiver.Id, 0)
+	for height := reward.Height + 1; height < reward.Height+params.CoinbaseMaturity; height++ {
+		if err := bc.VerifyTransaction(tx); err == nil {
+			t.Fatalf("Accepted spending the mining reward at height %d", height)
+		}
+		if _, err := bc.Send(miner, receiver.Id, 10, 0); err == nil {
+			t.Fatalf("Sent immature mining rewards at height %d", height)
+		}
+		if _, err := bc.MineNext(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := bc.VerifyTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.Send(miner, receiver.Id, 10, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.MineNext(); err != nil {
+		t.Fatal(err)
+	}
+	if balance := bc.GetUTxOsForUser(receiver.Id).Balance(); balance != 10 {
+		t.Fatalf("Expected balance 10, got %d", balance)
+	}
+}
+
+func TestSplitReward(t *testing.T) {
+	a, b, c := AccountId{1}, AccountId{2}, AccountId{3}
+	outputs := splitReward(100, map[AccountId]uint64{c: 1, a: 1, b: 1})
+	if len(outputs) != 3 || outputs[0].To != a || outputs[0].Value != 34 || outputs[1].Value != 33 || outputs[2].Value != 33 {
+		t.Fatalf("Unexpected split %+v", outputs)
+	}
+	// Parts which round down to zero are left out, the remainder goes to the first account
+	outputs = splitReward(10, map[AccountId]uint64{a: 1000, b: 1})
+	if len(outputs) != 1 || outputs[0].To != a || outputs[0].Value != 10 {
+		t.Fatalf("Unexpected split %+v", outputs)
+	}
+	outputs = splitReward(math.MaxUint64, map[AccountId]uint64{a: 1, b: 3})
+	if outputs[0].Value+outputs[1].Value != math.MaxUint64 || outputs[1].Value != 3<<62-1 {
+		t.Fatalf("Unexpected split %+v", outputs)
+	}
+	if outputs = splitReward(0, map[AccountId]uint64{a: 1}); len(outputs) != 1 || outputs[0].Value != 0 {
+		t.Fatalf("Unexpected split %+v", outputs)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// Maximum number of block hashes sent in response to a getblocks message
+	maxInvBlocks int = 500
+	// Maximum number of headers sent in response to a getheaders message
+	maxHeaders int = 2000
+	// Number of block bodies requested from a peer with a single getdata message
+	bodyBatchSize int = 16
+	// Maximum number of requested bodies which have not been connected yet
+	maxBodiesInFlight int           = 128
+	syncStallTimeout  time.Duration = 30 * time.Second
+)
+
+// Requests the hashes of the blocks following the first locator hash the remote knows
+type GetBlocksPayload struct {
+	// Hashes of blocks in the senders chain, newest first.
+	// Empty if the senders chain is empty.
+	Locator []SHA256Sum
+}
+
+type HeadersPayload struct {
+	Headers []BlockHeader
+}
+
+// Passed to the progress callback after every block connected during a sync
+type SyncProgress struct {
+	Height       uint64
+	TargetHeight uint64
+}
+
+type syncState struct {
+	peer         *Peer
+	target       SHA256Sum
+	targetHeight uint64
+	// Set while a getblocks request is unanswered
+	batchPending bool
+	// The last block announced in response to the current getblocks request
+	batchEnd   SHA256Sum
+	onProgress func(SyncProgress)
+	progressed chan struct{}
+	done       chan error
+}
+
+type headersSyncState struct {
+	// The peer the headers are downloaded from
+	peer    *Peer
+	headers chan []BlockHeader
+	// Bodies which have been requested but not received yet
+	requested map[SHA256Sum]bool
+	bodies    chan *Block
+}
+
+// Ends the sync. Only the first result is kept.
+func (state *syncState) finish(err error) {
+	select {
+	case state.done <- err:
+	default:
+	}
+}
+
+// Builds a block locator for the chain.
+// The most recent blocks are listed densely, older ones exponentially sparser
+// and the genesis block is always last, so a peer can find the fork point quickly.
+func (bc *Blockchain) Locator() []SHA256Sum {
+	return locatorFor(bc.MainChain())
+}
+
+// Builds a locator for a list of hashes starting with the genesis block
+func locatorFor(chain []SHA256Sum) []SHA256Sum {
+	locator := make([]SHA256Sum, 0)
+	step := 1
+	for i := len(chain) - 1; i > 0; i -= step {
+		locator = append(locator, chain[i])
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	if len(chain) > 0 {
+		locator = append(locator, chain[0])
+	}
+	return locator
+}
+
+// Returns the index in the chain after the first locator hash which is part of it.
+// Without a common block the whole chain is sent, starting at index 0.
+func locateStart(chain []SHA256Sum, locator []SHA256Sum) int {
+	heights := make(map[SHA256Sum]int)
+	for height, hash := range chain {
+		heights[hash] = height
+	}
+	for _, hash := range locator {
+		if height, ok := heights[hash]; ok {
+			return height + 1
+		}
+	}
+	return 0
+}
+
+// Downloads all blocks of a peers chain which are missing locally.
+// Every block is verified and appended to the chain.
+// Returns once the latest block the peer announced in its version has been connected.
+func (n *Node) Sync(addr string, onProgress func(SyncProgress)) error {
+	peer, err := n.Connect(addr)
+	if err != nil {
+		return err
+	}
+	if peer.version.LatestBlock == nullHash {
+		// Nothing to download
+		return nil
+	}
+
+	n.chainMu.Lock()
+	synced := n.bc.HasBlock(peer.version.LatestBlock)
+	locator := n.bc.Locator()
+	n.chainMu.Unlock()
+	if synced {
+		return nil
+	}
+
+	state := &syncState{
+		peer:         peer,
+		target:       peer.version.LatestBlock,
+		targetHeight: peer.version.LatestHeight,
+		batchPending: true,
+		onProgress:   onProgress,
+		progressed:   make(chan struct{}, 1),
+		done:         make(chan error, 1),
+	}
+	n.syncMu.Lock()
+	if n.sync != nil || n.headersSync != nil {
+		n.syncMu.Unlock()
+		return errors.New("Already syncing")
+	}
+	n.sync = state
+	n.syncMu.Unlock()
+	defer func() {
+		n.syncMu.Lock()
+		n.sync = nil
+		n.syncMu.Unlock()
+	}()
+
+	fmt.Printf("Syncing %d blocks from %s\n", state.targetHeight+1, addr)
+	if err := peer.Send(MsgGetBlocks, &GetBlocksPayload{Locator: locator}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case err := <-state.done:
+			return err
+		case <-state.progressed:
+		case <-time.After(syncStallTimeout):
+			return errors.New(fmt.Sprintf("Sync with %s stalled", addr))
+		}
+	}
+}
+
+// Sends the hashes of the blocks following the locator in the main chain
+func (n *Node) handleGetBlocks(peer *Peer, getBlocks *GetBlocksPayload) error {
+	n.chainMu.Lock()
+	chain := n.bc.MainChain()
+	n.chainMu.Unlock()
+
+	start := locateStart(chain, getBlocks.Locator)
+	end := start + maxInvBlocks
+	if end > len(chain) {
+		end = len(chain)
+	}
+
+	items := make([]InvItem, 0, end-start)
+	for _, hash := range chain[start:end] {
+		items = append(items, InvItem{Type: InvBlock, Hash: hash})
+	}
+	return peer.Send(MsgInv, &InvPayload{Items: items})
+}
+
+// Records the end of a batch announced by the sync peer in response to getblocks
+func (n *Node) syncBatchReceived(peer *Peer, inv *InvPayload) {
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+	state := n.sync
+	if state == nil || state.peer != peer || !state.batchPending {
+		return
+	}
+	if len(inv.Items) == 0 {
+		// The peer has nothing after our latest common block,
+		// even though we don't have its latest block.
+		state.finish(errors.New("Peer has no blocks extending the local chain"))
+		return
+	}
+	for _, item := range inv.Items {
+		if item.Type == InvBlock {
+			state.batchEnd = item.Hash
+			state.batchPending = false
+		}
+	}
+}
+
+// Reports progress and requests the next batch once the current one is connected
+func (n *Node) syncBlockConnected(block *Block, height uint64) {
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+	state := n.sync
+	if state == nil {
+		return
+	}
+
+	if state.onProgress != nil {
+		state.onProgress(SyncProgress{
+			Height:       height,
+			TargetHeight: state.targetHeight,
+		})
+	}
+	select {
+	case state.progressed <- struct{}{}:
+	default:
+	}
+
+	if block.PoW.Hash == state.target {
+		state.finish(nil)
+		return
+	}
+	if !state.batchPending && block.PoW.Hash == state.batchEnd {
+		n.chainMu.Lock()
+		locator := n.bc.Locator()
+		n.chainMu.Unlock()
+		state.batchPending = true
+		if err := state.peer.Send(MsgGetBlocks, &GetBlocksPayload{Locator: locator}); err != nil {
+			state.finish(err)
+		}
+	}
+}
+
+// Downloads and validates the header chain from the first peer,
+// then downloads the block bodies from all peers in parallel.
+// Bodies are connected in order as soon as all their predecessors are connected.
+func (n *Node) SyncHeadersFirst(addrs []string, onProgress func(SyncProgress)) error {
+	if len(addrs) == 0 {
+		return errors.New("No peers to sync from")
+	}
+	peers := make([]*Peer, 0, len(addrs))
+	for _, addr := range addrs {
+		peer, err := n.Connect(addr)
+		if err != nil {
+			return err
+		}
+		peers = append(peers, peer)
+	}
+
+	state := &headersSyncState{
+		peer:      peers[0],
+		headers:   make(chan []BlockHeader, 1),
+		requested: make(map[SHA256Sum]bool),
+		bodies:    make(chan *Block, maxBodiesInFlight),
+	}
+	n.syncMu.Lock()
+	if n.sync != nil || n.headersSync != nil {
+		n.syncMu.Unlock()
+		return errors.New("Already syncing")
+	}
+	n.headersSync = state
+	n.syncMu.Unlock()
+	defer func() {
+		n.syncMu.Lock()
+		n.headersSync = nil
+		n.syncMu.Unlock()
+	}()
+
+	if err := n.downloadHeaders(state); err != nil {
+		return err
+	}
+	return n.downloadBodies(state, peers, onProgress)
+}
+
+// Extends the header chain until the peer has no more headers
+func (n *Node) downloadHeaders(state *headersSyncState) error {
+	for {
+		n.chainMu.Lock()
+		locator := locatorFor(n.bc.HeaderChain())
+		n.chainMu.Unlock()
+		if err := state.peer.Send(MsgGetHeaders, &GetBlocksPayload{Locator: locator}); err != nil {
+			return err
+		}
+
+		var headers []BlockHeader
+		select {
+		case headers = <-state.headers:
+		case <-time.After(syncStallTimeout):
+			return errors.New(fmt.Sprintf("Header download from %s stalled", state.peer.Addr))
+		}
+
+		n.chainMu.Lock()
+		for i := range headers {
+			if err := n.bc.AddHeader(&headers[i]); err != nil {
+				n.chainMu.Unlock()
+				return err
+			}
+		}
+		n.chainMu.Unlock()
+		fmt.Printf("Downloaded %d headers\n", len(headers))
+
+		if len(headers) < maxHeaders {
+			return nil
+		}
+	}
+}
+
+// Downloads the bodies for all headers of the header chain which are missing and connects them
+func (n *Node) downloadBodies(state *headersSyncState, peers []*Peer, onProgress func(SyncProgress)) error {
+	n.chainMu.Lock()
+	headerChain := n.bc.HeaderChain()
+	missing := make([]SHA256Sum, 0)
+	for _, hash := range headerChain {
+		if !n.bc.HasBlock(hash) {
+			missing = append(missing, hash)
+		}
+	}
+	n.chainMu.Unlock()
+	targetHeight := uint64(len(headerChain) - 1)
+
+	buffered := make(map[SHA256Sum]*Block)
+	nextRequest := 0
+	nextConnect := 0
+	for nextConnect < len(missing) {
+		// Keep requests in flight, spread over all peers
+		for nextRequest < len(missing) && nextRequest-nextConnect < maxBodiesInFlight {
+			end := nextRequest + bodyBatchSize
+			if end > len(missing) {
+				end = len(missing)
+			}
+			if end > nextConnect+maxBodiesInFlight {
+				end = nextConnect + maxBodiesInFlight
+			}
+			items := make([]InvItem, 0, end-nextRequest)
+			n.syncMu.Lock()
+			for _, hash := range missing[nextRequest:end] {
+				state.requested[hash] = true
+				items = append(items, InvItem{Type: InvBlock, Hash: hash})
+			}
+			n.syncMu.Unlock()
+			peer := peers[(nextRequest/bodyBatchSize)%len(peers)]
+			if err := peer.Send(MsgGetData, &InvPayload{Items: items}); err != nil {
+				return err
+			}
+			nextRequest = end
+		}
+
+		select {
+		case block := <-state.bodies:
+			buffered[block.PoW.Hash] = block
+		case <-time.After(syncStallTimeout):
+			return errors.New("Block download stalled")
+		}
+
+		for nextConnect < len(missing) {
+			block := buffered[missing[nextConnect]]
+			if block == nil {
+				break
+			}
+			delete(buffered, block.PoW.Hash)
+
+			var height uint64
+			err := n.updateChain(func() error {
+				if err := n.bc.verifyBlockStructure(block); err != nil {
+					return err
+				}
+				if err := n.bc.AddBlock(block); err != nil {
+					return err
+				}
+				height = n.bc.Height()
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			if onProgress != nil {
+				onProgress(SyncProgress{
+					Height:       height,
+					TargetHeight: targetHeight,
+				})
+			}
+			nextConnect++
+		}
+	}
+	return nil
+}
+
+// Sends the headers following the locator in the main chain
+func (n *Node) handleGetHeaders(peer *Peer, getHeaders *GetBlocksPayload) error {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+	chain := n.bc.MainChain()
+
+	start := locateStart(chain, getHeaders.Locator)
+	end := start + maxHeaders
+	if end > len(chain) {
+		end = len(chain)
+	}
+
+	headers := make([]BlockHeader, 0, end-start)
+	for _, hash := range chain[start:end] {
+		header, err := n.bc.GetHeader(hash)
+		if err != nil {
+			return err
+		}
+		headers = append(headers, *header)
+	}
+	return peer.Send(MsgHeaders, &HeadersPayload{Headers: headers})
+}
+
+// Hands headers from the header sync peer to the headers first sync
+func (n *Node) headersReceived(peer *Peer, headers *HeadersPayload) {
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+	state := n.headersSync
+	if state == nil || state.peer != peer {
+		return
+	}
+	select {
+	case state.headers <- headers.Headers:
+	default:
+	}
+}
+
+// Hands a block body to the headers first sync if it was requested by it
+func (n *Node) headersSyncBodyReceived(block *Block) bool {
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+	state := n.headersSync
+	if state == nil || !state.requested[block.PoW.Hash] {
+		return false
+	}
+	delete(state.requested, block.PoW.Hash)
+	state.bodies <- block
+	return true
+}
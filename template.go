@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Everything an external miner needs to build and seal a block on top of the latest block
+type BlockTemplate struct {
+	Height        uint64
+	LastBlockHash SHA256Sum
+	Timestamp     int64
+	Target        SHA256Sum
+	// The mining reward transaction. The miner may change its extra nonce and tag.
+	Coinbase *Tx
+	// All other transactions, in block order
+	Transactions []*Tx
+}
+
+// Creates a template for a block on top of the latest block paying the mining reward to `payTo`.
+// The transactions stay in the mempool until a block containing them is added.
+func (bc *Blockchain) GetBlockTemplate(payTo AccountId) (*BlockTemplate, error) {
+	return bc.GetSharedBlockTemplate(map[AccountId]uint64{payTo: 1})
+}
+
+// Creates a template like GetBlockTemplate, splitting the mining reward between the accounts
+// in proportion to their shares, e.g. to pay the workers of a mining pool.
+func (bc *Blockchain) GetSharedBlockTemplate(shares map[AccountId]uint64) (*BlockTemplate, error) {
+	block, err := bc.prepareBlock(shares)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockTemplate{
+		Height:        block.Transactions[0].Coinbase.Height,
+		LastBlockHash: block.LastBlockHash,
+		Timestamp:     block.Timestamp,
+		Target:        block.Target,
+		Coinbase:      block.Transactions[0],
+		Transactions:  block.Transactions[1:],
+	}, nil
+}
+
+// Builds the unsealed block of the template, with the Merkle root set
+func (template *BlockTemplate) Block() *Block {
+	block := NewBlock()
+	block.AddTransaction(template.Coinbase)
+	for _, tx := range template.Transactions {
+		block.AddTransaction(tx)
+	}
+	block.LastBlockHash = template.LastBlockHash
+	block.Timestamp = template.Timestamp
+	block.Target = template.Target
+	block.MerkleRoot = block.CalcMerkleRoot()
+	return block
+}
+
+// Verifies a block sealed by an external miner with VerifyBlock and adds it to the chain.
+// The block has to extend the latest block, blocks for an outdated template are rejected as stale.
+func (bc *Blockchain) SubmitBlock(block *Block) error {
+	if block.PoW == nil || block.LastBlockHash == emptyHash {
+		return errors.New("Block is malformed")
+	}
+	for _, tx := range block.Transactions {
+		if tx == nil || !txWellFormed(tx) {
+			return errors.New("Block has a malformed transaction")
+		}
+	}
+	if bc.HasBlock(block.PoW.Hash) {
+		return errors.New(fmt.Sprintf("Block '%x' is already known", block.PoW.Hash))
+	}
+	if block.LastBlockHash != bc.latestBlock {
+		return errors.New(fmt.Sprintf("Block is stale, it doesn't extend the latest block '%x'", bc.latestBlock))
+	}
+	if err := bc.VerifyBlock(block); err != nil {
+		return err
+	}
+	return bc.AddBlock(block)
+}
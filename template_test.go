@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// Seals a block like an external miner would, without the chain
+func sealExternally(t *testing.T, block *Block) {
+	block.MerkleRoot = block.CalcMerkleRoot()
+	if err := NewPoWEngine(1).Seal(context.Background(), nil, &block.BlockHeader); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockTemplate(t *testing.T) {
+	nodes, miners := createTestNodes(t, 2)
+	connectLine(t, nodes)
+	node := nodes[0]
+	receiver, _ := NewAccount()
+	external, _ := NewAccount()
+	if _, err := node.Send(miners[0], receiver.Id, 10, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	template, err := node.GetBlockTemplate(external.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(template.Transactions) != 1 || node.bc.mempool.Count() != 1 {
+		t.Fatal("Template doesn't contain the mempool transaction or took it out of the mempool")
+	}
+	stale, err := node.GetBlockTemplate(external.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The external miner rolls the extra nonce before sealing
+	block := template.Block()
+	block.Transactions[0].Coinbase.ExtraNonce = 42
+	sealExternally(t, block)
+	if err := node.SubmitBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.SubmitBlock(block); err == nil {
+		t.Fatal("Accepted the same block twice")
+	}
+	if balance := node.bc.GetUTxOsForUser(external.Id).Balance(); balance != node.bc.params.InitialReward+3 {
+		t.Fatalf("Expected external miner balance %d, got %d", node.bc.params.InitialReward+3, balance)
+	}
+	if node.bc.mempool.Count() != 0 {
+		t.Fatal("Mined transaction is still in the mempool")
+	}
+	waitFor(t, "block propagation", func() bool {
+		nodes[1].chainMu.Lock()
+		defer nodes[1].chainMu.Unlock()
+		return nodes[1].bc.latestBlock == block.PoW.Hash
+	})
+
+	staleBlock := stale.Block()
+	sealExternally(t, staleBlock)
+	if err := node.SubmitBlock(staleBlock); err == nil {
+		t.Fatal("Accepted a block for an outdated template")
+	}
+}
+
+func TestBlockTemplateKeepsMempoolOrder(t *testing.T) {
+	nodes, miners := createTestNodes(t, 1)
+	node := nodes[0]
+	receiver, _ := NewAccount()
+	// Every transaction spends the mining reward of its own block
+	for i := 0; i < 2; i++ {
+		if _, err := node.MineNext(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Later transactions pay higher fees, so the template orders them differently
+	var sent []*Tx
+	for fee := uint64(1); fee <= 3; fee++ {
+		tx, err := node.Send(miners[0], receiver.Id, 10, fee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, tx)
+	}
+
+	template, err := node.GetBlockTemplate(receiver.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(template.Transactions) != len(sent) {
+		t.Fatalf("Expected %d transactions in the template, got %d", len(sent), len(template.Transactions))
+	}
+	txs := node.bc.mempool.Transactions()
+	if len(txs) != len(sent) {
+		t.Fatalf("Expected %d transactions in the mempool, got %d", len(sent), len(txs))
+	}
+	for i, tx := range txs {
+		if tx != sent[i] {
+			t.Fatal("Creating a template changed the order of the mempool")
+		}
+	}
+}
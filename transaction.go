@@ -5,6 +5,7 @@ import (
 	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/gob"
 	"errors"
 	"fmt"
 )
@@ -30,8 +31,26 @@ type Tx struct {
 	Outputs []TxO
 	// Every party contributing an input signs a hash of the transaction
 	Signatures map[AccountId]Signature
+	// Public keys of the signing parties, so nodes which don't have them
+	// in their keystore can still verify the signatures
+	Keys map[AccountId]ed25519.PublicKey
+	// Only set for mining reward transactions
+	Coinbase *CoinbaseData
 }
 
+// Data committed to by a mining reward transaction.
+// The height makes the hash of every mining reward transaction unique.
+type CoinbaseData struct {
+	Height uint64
+	// Rolled by miners to change the Merkle root once the nonces of the header are exhausted
+	ExtraNonce uint64
+	// Arbitrary data chosen by the miner
+	Tag []byte
+}
+
+// The longest tag a mining reward transaction may carry
+const maxCoinbaseTag int = 100
+
 func NewTx(inputs []TxI, outputs []TxO, sigs map[AccountId]Signature) *Tx {
 	return &Tx{
 		Inputs:     inputs,
@@ -40,17 +59,59 @@ func NewTx(inputs []TxI, outputs []TxO, sigs map[AccountId]Signature) *Tx {
 	}
 }
 
-// Verifies that all inputs have a valid signature and,
-// that value out equals value in.
+// Creates the mining reward transaction for a block at the given height
+func NewCoinbaseTx(height uint64, to AccountId, value uint64) *Tx {
+	tx := NewTx(
+		[]TxI{},
+		[]TxO{
+			{
+				To:    to,
+				Value: value,
+			},
+		},
+		map[AccountId]Signature{},
+	)
+	tx.Coinbase = &CoinbaseData{
+		Height: height,
+	}
+	return tx
+}
+
+// Returned if a transaction spends an output which is not unspent anymore,
+// either because it was spent in the chain or by an earlier transaction of the same block
+type DoubleSpendError struct {
+	Path TxOPath
+}
+
+func (err *DoubleSpendError) Error() string {
+	return fmt.Sprintf("Transaction invalid! Output %d of transaction %d in block '%x' is already spent.", err.Path.OutputIdx, err.Path.TxIdx, err.Path.BlockHash)
+}
+
+// Verifies that all inputs have a valid signature,
+// that they spend unspent outputs and that value out doesn't exceed value in.
+// The difference is the fee, which is claimed by the miner.
+// The transaction is verified for inclusion in the next block.
 // If the returned error is nil, the transaction is valid
 func (bc *Blockchain) VerifyTransaction(tx *Tx) error {
+	_, err := bc.verifyTransaction(tx, make(map[TxOPath]bool), bc.latestHeight+1)
+	return err
+}
+
+// Verifies a transaction for inclusion in a block at the given height like VerifyTransaction and returns its fee.
+// Outputs in `spent` count as spent, even though they are still in the UTxO set.
+// If the transaction is valid, the outputs it spends are added to `spent`.
+func (bc *Blockchain) verifyTransaction(tx *Tx, spent map[TxOPath]bool, height uint64) (uint64, error) {
+	if tx.Coinbase != nil {
+		return 0, errors.New("Transaction invalid! Only the first transaction of a block may be a mining reward.")
+	}
+
 	// Find all unique payers involved and get their public keys
 	payers := make(map[AccountId]ed25519.PublicKey)
 	for _, in := range tx.Inputs {
 		if payers[in.From] == nil {
-			pubKey, err := bc.GetKey(in.From)
+			pubKey, err := bc.payerKey(tx, in.From)
 			if err != nil {
-				return err
+				return 0, err
 			}
 			payers[in.From] = pubKey
 		}
@@ -61,41 +122,88 @@ func (bc *Blockchain) VerifyTransaction(tx *Tx) error {
 	for accId, pubKey := range payers {
 		sig, signed := tx.Signatures[accId]
 		if !signed {
-			return errors.New(fmt.Sprintf("Transaction invalid! No signature by '%x'.\n", accId))
+			return 0, errors.New(fmt.Sprintf("Transaction invalid! No signature by '%x'.\n", accId))
 		}
 		if !ed25519.Verify(pubKey, txHash[:], sig[:]) {
-			return errors.New(fmt.Sprintf("Transaction invalid! Signature by '%x' is incorrect!\n", accId))
+			return 0, errors.New(fmt.Sprintf("Transaction invalid! Signature by '%x' is incorrect!\n", accId))
+		}
+	}
+
+	// Verify that every input spends an unspent output of its payer
+	var valIn uint64
+	spentByTx := make(map[TxOPath]bool)
+	for _, in := range tx.Inputs {
+		if spent[*in.Output] || spentByTx[*in.Output] {
+			return 0, &DoubleSpendError{Path: *in.Output}
+		}
+		utxo := bc.findUTxO(in.From, *in.Output)
+		if utxo == nil {
+			out, err := bc.findOutput(*in.Output)
+			if err != nil {
+				return 0, err
+			}
+			if out.To != in.From {
+				return 0, errors.New(fmt.Sprintf("Transaction invalid! Output spent by '%x' belongs to '%x'.", in.From, out.To))
+			}
+			return 0, &DoubleSpendError{Path: *in.Output}
+		}
+		if !utxo.Mature(height, bc.params.CoinbaseMaturity) {
+			return 0, errors.New(fmt.Sprintf("Transaction invalid! Mining reward from height %d can't be spent before height %d.", utxo.Height, utxo.Height+bc.params.CoinbaseMaturity))
 		}
+		spentByTx[*in.Output] = true
+		valIn += utxo.Value
 	}
 
 	// Verify that the transaction doesn't output more coins than the inputs provide
 	var valOut uint64
 	for _, out := range tx.Outputs {
+		if valOut+out.Value < valOut {
+			return 0, errors.New("Transaction invalid! Value out overflows")
+		}
 		valOut += out.Value
 	}
-	var valIn uint64
-	for _, in := range tx.Inputs {
-		block, err := bc.GetBlock(in.Output.BlockHash)
-		if err != nil {
-			return errors.New(fmt.Sprintf("Unable to find block '%x'\n", in.Output.BlockHash))
-		}
+	if valOut > valIn {
+		return 0, errors.New(fmt.Sprintf("Transaction invalid! Value out (%d) exceeds value in (%d)", valOut, valIn))
+	}
 
-		if uint32(len(block.Transactions)) <= in.Output.TxIdx {
-			return errors.New(fmt.Sprintf("Unable to get Tx %d in block '%x'\n", in.Output.TxIdx, in.Output.BlockHash))
-		}
-		refTx := block.Transactions[in.Output.TxIdx]
+	for path := range spentByTx {
+		spent[path] = true
+	}
+	return valIn - valOut, nil
+}
 
-		if uint32(len(refTx.Outputs)) <= in.Output.OutputIdx {
-			return errors.New(fmt.Sprintf("Unable to get output %d in transaction %d\n", in.Output.OutputIdx, in.Output.TxIdx))
-		}
-		out := refTx.Outputs[in.Output.OutputIdx]
-		valIn += out.Value
+// Finds an output in the stored blocks, regardless of whether it is spent
+func (bc *Blockchain) findOutput(path TxOPath) (*TxO, error) {
+	block, err := bc.GetBlock(path.BlockHash)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to find block '%x'\n", path.BlockHash))
 	}
-	if valOut != valIn {
-		return errors.New(fmt.Sprintf("Transaction invalid! Value in (%d) does not match value out (%d)", valIn, valOut))
+
+	if uint32(len(block.Transactions)) <= path.TxIdx {
+		return nil, errors.New(fmt.Sprintf("Unable to get Tx %d in block '%x'\n", path.TxIdx, path.BlockHash))
 	}
+	refTx := block.Transactions[path.TxIdx]
 
-	return nil
+	if uint32(len(refTx.Outputs)) <= path.OutputIdx {
+		return nil, errors.New(fmt.Sprintf("Unable to get output %d in transaction %d\n", path.OutputIdx, path.TxIdx))
+	}
+	return &refTx.Outputs[path.OutputIdx], nil
+}
+
+// Gets the public key of a payer, preferring the key shipped with the transaction.
+// A shipped key is only accepted if it has the size of an Ed25519 key and actually hashes to the payers account id.
+func (bc *Blockchain) payerKey(tx *Tx, accId AccountId) (ed25519.PublicKey, error) {
+	if pubKey, ok := tx.Keys[accId]; ok {
+		// ed25519.Verify panics on keys of another size
+		if len(pubKey) != ed25519.PublicKeySize {
+			return nil, errors.New(fmt.Sprintf("Transaction invalid! Public key of '%x' has %d bytes instead of %d.\n", accId, len(pubKey), ed25519.PublicKeySize))
+		}
+		if AccountId(sha256.Sum256(pubKey)) != accId {
+			return nil, errors.New(fmt.Sprintf("Transaction invalid! Public key does not match account '%x'.\n", accId))
+		}
+		return pubKey, nil
+	}
+	return bc.GetKey(accId)
 }
 
 func (txop *TxOPath) Binary() []byte {
@@ -119,6 +227,12 @@ func (tx *Tx) Binary() []byte {
 		binary.LittleEndian.PutUint64(valRaw, out.Value)
 		parts = append(parts, out.To[:], valRaw)
 	}
+	if tx.Coinbase != nil {
+		coinbaseRaw := make([]byte, 16)
+		binary.LittleEndian.PutUint64(coinbaseRaw[0:8], tx.Coinbase.Height)
+		binary.LittleEndian.PutUint64(coinbaseRaw[8:16], tx.Coinbase.ExtraNonce)
+		parts = append(parts, coinbaseRaw, tx.Coinbase.Tag)
+	}
 	return bytes.Join(parts, []byte{})
 }
 
@@ -127,6 +241,28 @@ func (tx *Tx) Hash() SHA256Sum {
 	return sha256.Sum256(tx.Binary())
 }
 
+func (tx *Tx) Serialize() []byte {
+	buf := bytes.Buffer{}
+	encoder := gob.NewEncoder(&buf)
+	err := encoder.Encode(tx)
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TxDeserialize(raw []byte) *Tx {
+	var tx Tx
+	buf := bytes.Buffer{}
+	buf.Write(raw)
+	decoder := gob.NewDecoder(&buf)
+	err := decoder.Decode(&tx)
+	if err != nil {
+		panic(err)
+	}
+	return &tx
+}
+
 // Print the transaction to stdout for debugging
 func (tx *Tx) Print(prefix string) {
 	fmt.Printf("%sTRANSACTION\n", prefix)
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// An output removed from the UTxO set when a block was connected
+type SpentUTxO struct {
+	Owner AccountId
+	UTxO  UTxO
+}
+
+// The information needed to disconnect a block from the UTxO set
+type BlockUndo struct {
+	// The outputs spent by each transaction of the block, indexed like the transactions
+	Spent [][]SpentUTxO
+}
+
+func (undo *BlockUndo) Serialize() []byte {
+	buf := bytes.Buffer{}
+	encoder := gob.NewEncoder(&buf)
+	err := encoder.Encode(undo)
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func BlockUndoDeserialize(raw []byte) *BlockUndo {
+	var undo BlockUndo
+	buf := bytes.Buffer{}
+	buf.Write(raw)
+	decoder := gob.NewDecoder(&buf)
+	err := decoder.Decode(&undo)
+	if err != nil {
+		panic(err)
+	}
+	return &undo
+}
+
+func (bc *Blockchain) putUndo(t *bolt.Tx, blockHash SHA256Sum, undo *BlockUndo) {
+	bucket := bc.bucket(t, undoBucketName)
+	bucket.Put(blockHash[:], undo.Serialize())
+}
+
+// Disconnects the latest block from the main chain.
+// The UTxO set is reverted using the undo data stored when the block was connected.
+// The block stays in the chain bucket and is returned.
+func (bc *Blockchain) DisconnectBlock() (*Block, error) {
+	if bc.IsEmpty() {
+		return nil, errors.New("Can't disconnect a block from an empty chain")
+	}
+	block, err := bc.GetBlock(bc.latestBlock)
+	if err != nil {
+		return nil, err
+	}
+	if block.LastBlockHash == nullHash {
+		return nil, errors.New("Can't disconnect the genesis block")
+	}
+
+	err = bc.db.Update(func(t *bolt.Tx) error {
+		raw := bc.bucket(t, undoBucketName).Get(block.PoW.Hash[:])
+		if raw == nil {
+			return errors.New(fmt.Sprintf("No undo data for block '%x'", block.PoW.Hash))
+		}
+		undo := BlockUndoDeserialize(raw)
+
+		// Undo the transactions in reverse, so outputs spent within the block exist again
+		utxoMap := NewUTxOMap(t, bc.params)
+		for txIdx := len(block.Transactions) - 1; txIdx >= 0; txIdx-- {
+			utxoMap.RemoveOutputs(block.Transactions[txIdx], uint32(txIdx), block.PoW.Hash)
+			utxoMap.RestoreOutputs(undo.Spent[txIdx])
+		}
+		utxoMap.Persist()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bc.setTip(block.LastBlockHash); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// Disconnects blocks from the main chain until the latest block has the given height
+func (bc *Blockchain) RewindTo(height uint64) error {
+	for bc.Height() > height {
+		if _, err := bc.DisconnectBlock(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
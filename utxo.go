@@ -12,6 +12,16 @@ import (
 type UTxO struct {
 	Value uint64
 	Path  TxOPath
+	// Whether the output was created by a mining reward transaction
+	Coinbase bool
+	// Height of the block which created the output
+	Height uint64
+}
+
+// Whether the output can be spent by a transaction in a block at the given height.
+// Mining rewards have to mature first, as they vanish if their block is disconnected.
+func (utxo *UTxO) Mature(height uint64, maturity uint64) bool {
+	return !utxo.Coinbase || height >= utxo.Height+maturity
 }
 
 // A slice of unspent transaction outputs
@@ -40,11 +50,11 @@ type UTxOMap struct {
 	utxoBucket *bolt.Bucket
 }
 
-func NewUTxOMap(t *bolt.Tx) *UTxOMap {
+func NewUTxOMap(t *bolt.Tx, params *ChainParams) *UTxOMap {
 	if !t.Writable() {
 		panic("Can't create UTxO map from readonly transaction")
 	}
-	utxoBucket := t.Bucket([]byte(utxoBucketName))
+	utxoBucket := t.Bucket([]byte(params.bucketName(utxoBucketName)))
 	if utxoBucket == nil {
 		panic("UTxO bucket not found!")
 	}
@@ -85,7 +95,9 @@ func (utxoMap *UTxOMap) Set(user AccountId, utxos UTxOs) {
 }
 
 // Removes the outputs spent by a transaction from the map
-func (utxoMap *UTxOMap) RemoveOutputsForInputs(tx *Tx) {
+// Returns the removed outputs, so they can be restored when the transaction is undone
+func (utxoMap *UTxOMap) RemoveOutputsForInputs(tx *Tx) []SpentUTxO {
+	spent := make([]SpentUTxO, 0, len(tx.Inputs))
 	for _, in := range tx.Inputs {
 		// The list of outputs by the sender
 		sendersOutputs := *utxoMap.Get(in.From)
@@ -106,13 +118,18 @@ func (utxoMap *UTxOMap) RemoveOutputsForInputs(tx *Tx) {
 			panic("Did not find matching output for input in UTxO generation")
 		} else {
 			// Remove the spent output
+			spent = append(spent, SpentUTxO{
+				Owner: in.From,
+				UTxO:  *sendersOutputs[removeOutputIdx],
+			})
 			sendersOutputs[removeOutputIdx] = sendersOutputs[len(sendersOutputs)-1]
 			utxoMap.Set(in.From, sendersOutputs[:len(sendersOutputs)-1])
 		}
 	}
+	return spent
 }
 
-func (utxoMap *UTxOMap) AddOutputs(tx *Tx, txIdx uint32, blockHash SHA256Sum) {
+func (utxoMap *UTxOMap) AddOutputs(tx *Tx, txIdx uint32, blockHash SHA256Sum, height uint64) {
 	for outIdx, out := range tx.Outputs {
 		utxos := append(*utxoMap.Get(out.To), &UTxO{
 			Value: out.Value,
@@ -121,11 +138,42 @@ func (utxoMap *UTxOMap) AddOutputs(tx *Tx, txIdx uint32, blockHash SHA256Sum) {
 				TxIdx:     txIdx,
 				OutputIdx: uint32(outIdx),
 			},
+			Coinbase: txIdx == 0,
+			Height:   height,
 		})
 		utxoMap.Set(out.To, utxos)
 	}
 }
 
+// Removes the outputs created by a transaction from the map. The inverse of AddOutputs.
+func (utxoMap *UTxOMap) RemoveOutputs(tx *Tx, txIdx uint32, blockHash SHA256Sum) {
+	for outIdx, out := range tx.Outputs {
+		ownersOutputs := *utxoMap.Get(out.To)
+		removeOutputIdx := -1
+		for idx, output := range ownersOutputs {
+			if output.Path.BlockHash == blockHash &&
+				output.Path.TxIdx == txIdx &&
+				output.Path.OutputIdx == uint32(outIdx) {
+				removeOutputIdx = idx
+				break
+			}
+		}
+		if removeOutputIdx == -1 {
+			panic("Did not find output to remove when undoing a transaction")
+		}
+		ownersOutputs[removeOutputIdx] = ownersOutputs[len(ownersOutputs)-1]
+		utxoMap.Set(out.To, ownersOutputs[:len(ownersOutputs)-1])
+	}
+}
+
+// Adds previously spent outputs back to the map. The inverse of RemoveOutputsForInputs.
+func (utxoMap *UTxOMap) RestoreOutputs(spent []SpentUTxO) {
+	for _, s := range spent {
+		utxo := s.UTxO
+		utxoMap.Set(s.Owner, append(*utxoMap.Get(s.Owner), &utxo))
+	}
+}
+
 // Writes all values of the map back to the database
 func (utxoMap *UTxOMap) Persist() {
 	for owner, UTxOs := range utxoMap.Map {
@@ -134,27 +182,23 @@ func (utxoMap *UTxOMap) Persist() {
 }
 
 // (Re)creates the UTxO-Set by iterating over the entire blockchain
+// The undo data of all blocks in the main chain is recreated as well.
 func (bc *Blockchain) GenerateUTxO() {
 	// Empty the UTxO bucket
-	if err := recreateBucket(bc.db, utxoBucketName); err != nil {
+	if err := recreateBucket(bc.db, bc.params.bucketName(utxoBucketName)); err != nil {
 		panic(err)
 	}
 
+	mainChain := bc.MainChain()
 	bc.db.Update(func(t *bolt.Tx) error {
-		chainBucket := t.Bucket([]byte(chainBucketName))
-		utxoMap := NewUTxOMap(t)
-
-		currBlockHash := bc.latestBlock
-		var currBlock *Block
-		for currBlockHash != nullHash {
-			currBlock = BlockDeserialize(chainBucket.Get(currBlockHash[:]))
-
-			for txIdx, tx := range currBlock.Transactions {
-				utxoMap.RemoveOutputsForInputs(tx)
-				utxoMap.AddOutputs(tx, uint32(txIdx), currBlockHash)
-			}
+		chainBucket := bc.bucket(t, chainBucketName)
+		utxoMap := NewUTxOMap(t, bc.params)
 
-			currBlockHash = currBlock.LastBlockHash
+		// Outputs have to be added before they can be spent, so start at the genesis block
+		for height, blockHash := range mainChain {
+			block := BlockDeserialize(chainBucket.Get(blockHash[:]))
+			undo := applyBlock(utxoMap, block, uint64(height))
+			bc.putUndo(t, blockHash, undo)
 		}
 
 		utxoMap.Persist()
@@ -164,18 +208,29 @@ func (bc *Blockchain) GenerateUTxO() {
 }
 
 // Changes the UTxO-Set by applying the transactions in a given block to it
+// and stores the undo data needed to revert it
 func (bc *Blockchain) UpdateUTxOSet(block *Block) {
 	bc.db.Update(func(t *bolt.Tx) error {
-		utxoMap := NewUTxOMap(t)
-		for txIdx, tx := range block.Transactions {
-			utxoMap.RemoveOutputsForInputs(tx)
-			utxoMap.AddOutputs(tx, uint32(txIdx), block.PoW.Hash)
-		}
+		utxoMap := NewUTxOMap(t, bc.params)
+		undo := applyBlock(utxoMap, block, bc.getIndex(t, block.PoW.Hash).Height)
 		utxoMap.Persist()
+		bc.putUndo(t, block.PoW.Hash, undo)
 		return nil
 	})
 }
 
+// Applies the transactions of a block at the given height to the map and returns the undo data
+func applyBlock(utxoMap *UTxOMap, block *Block, height uint64) *BlockUndo {
+	undo := &BlockUndo{
+		Spent: make([][]SpentUTxO, len(block.Transactions)),
+	}
+	for txIdx, tx := range block.Transactions {
+		undo.Spent[txIdx] = utxoMap.RemoveOutputsForInputs(tx)
+		utxoMap.AddOutputs(tx, uint32(txIdx), block.PoW.Hash, height)
+	}
+	return undo
+}
+
 func UTxOsDeserialize(rawUTxOs []byte) *UTxOs {
 	var utxos UTxOs
 	buf := bytes.Buffer{}
@@ -191,7 +246,7 @@ func UTxOsDeserialize(rawUTxOs []byte) *UTxOs {
 func (bc *Blockchain) GetUTxOsForUser(user AccountId) *UTxOs {
 	var rawUTxOs []byte
 	bc.db.View(func(t *bolt.Tx) error {
-		utxoBucket := t.Bucket([]byte(utxoBucketName))
+		utxoBucket := bc.bucket(t, utxoBucketName)
 		rawUTxOs = utxoBucket.Get(user[:])
 		return nil
 	})
@@ -201,3 +256,14 @@ func (bc *Blockchain) GetUTxOsForUser(user AccountId) *UTxOs {
 		return &UTxOs{}
 	}
 }
+
+// Finds an unspent output of a user by its path
+// Returns nil if the user has no such unspent output
+func (bc *Blockchain) findUTxO(user AccountId, path TxOPath) *UTxO {
+	for _, utxo := range *bc.GetUTxOsForUser(user) {
+		if utxo.Path == path {
+			return utxo
+		}
+	}
+	return nil
+}